@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+** Each alert gets an id, and its notifications a link to acknowledge it on the
+** server. The repeated notifications of an acknowledged alert are not sent, until
+** the alert ends. The link shows a page with a button, so that a mail client
+** opening the links doesn't acknowledge the alert.
+ */
+
+const (
+	ACK_PATH = "/ack/"
+)
+
+type alertAck struct {
+	id    string
+	acked bool
+	by    string
+	at    time.Time
+}
+
+//the alert of each query in alert
+var g_acks = struct {
+	list map[string]*alertAck
+	sync.Mutex
+}{list: make(map[string]*alertAck)}
+
+type ackPage struct {
+	Name    string
+	Id      string
+	Acked   bool
+	By      string
+	At      string
+	Message string
+}
+
+var g_ackTemplate = template.Must(template.New("ack").Parse(ACK_TEMPLATE))
+
+func newAlertId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().Format("20060102150405.000000")
+	}
+	return hex.EncodeToString(id)
+}
+
+// startAlert gives an id to the new alert of a query
+func startAlert(name string) string {
+	g_acks.Lock()
+	defer g_acks.Unlock()
+	ack := &alertAck{id: newAlertId()}
+	g_acks.list[name] = ack
+	return ack.id
+}
+
+// endAlert forgets the alert of a query, and gives it
+func endAlert(name string) (alertAck, bool) {
+	g_acks.Lock()
+	defer g_acks.Unlock()
+	ack, ok := g_acks.list[name]
+	if !ok {
+		return alertAck{}, false
+	}
+	delete(g_acks.list, name)
+	return *ack, true
+}
+
+func isAcked(name string) bool {
+	g_acks.Lock()
+	defer g_acks.Unlock()
+	ack, ok := g_acks.list[name]
+	return ok && ack.acked
+}
+
+// ackAlert acknowledges the alert with the id, and gives its query
+func ackAlert(id string, by string) (string, error) {
+	g_acks.Lock()
+	defer g_acks.Unlock()
+	for name, ack := range g_acks.list {
+		if ack.id == id {
+			if !ack.acked {
+				ack.acked, ack.by, ack.at = true, by, time.Now()
+				eslog.Info("%s : alert %s acknowledged by %s", name, id, by)
+			}
+			return name, nil
+		}
+	}
+	return "", errors.New("unknown alert, it may have ended")
+}
+
+// ackQuery acknowledges the current alert of a query
+func ackQuery(name string, by string) error {
+	g_acks.Lock()
+	ack, ok := g_acks.list[name]
+	g_acks.Unlock()
+	if !ok {
+		return errors.New("the query " + name + " is not in alert")
+	}
+	_, err := ackAlert(ack.id, by)
+	return err
+}
+
+// setAckStats shows the alert and its acknowledgement in the stats
+func setAckStats(s *queryStats, name string) {
+	g_acks.Lock()
+	defer g_acks.Unlock()
+	s.AlertId, s.AckBy, s.AckAt = "None", "None", "None"
+	if ack, ok := g_acks.list[name]; ok {
+		s.AlertId = ack.id
+		if ack.acked {
+			s.AckBy = ack.by
+			s.AckAt = ack.at.Format(TIMELAYOUT)
+		}
+	}
+}
+
+// getAckLink gives the link to acknowledge an alert, if the url of the server
+// is known
+func getAckLink(id string) string {
+	url := config.G_Config.Config.Server_url
+	if url == "" || !isServer() {
+		return ""
+	}
+	return strings.TrimSuffix(url, "/") + strings.TrimSuffix(serverPath(), "/") + ACK_PATH + id
+}
+
+// getAckUser gives who acknowledges: the user of the basic authentication, or
+// the name given in the form
+func getAckUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if by := strings.TrimSpace(r.FormValue("by")); by != "" {
+		return by
+	}
+	return "unknown"
+}
+
+// newAckHandler gives the handler of the links, under prefix
+func newAckHandler(prefix string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := ackPage{Id: strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")}
+		code := http.StatusOK
+		switch r.Method {
+		case "GET":
+			if !getAckPage(&page) {
+				code = http.StatusNotFound
+			}
+		case "POST":
+			if _, err := ackAlert(page.Id, getAckUser(r)); err != nil {
+				page.Message = err.Error()
+				code = http.StatusNotFound
+			} else {
+				getAckPage(&page)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		g_ackTemplate.Execute(w, page)
+	}
+}
+
+// getAckPage fills the page with the alert of the id, false if it is unknown
+func getAckPage(page *ackPage) bool {
+	g_acks.Lock()
+	defer g_acks.Unlock()
+	for name, ack := range g_acks.list {
+		if ack.id == page.Id {
+			page.Name = name
+			page.Acked = ack.acked
+			page.By = ack.by
+			page.At = ack.at.Format(TIMELAYOUT)
+			return true
+		}
+	}
+	page.Message = "Unknown alert, it may have ended."
+	return false
+}
+
+const ACK_TEMPLATE = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>eschecker</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #333; }
+</style>
+</head>
+<body>
+<h1>eschecker</h1>
+{{if .Message}}<p>{{.Message}}</p>
+{{else if .Acked}}<p>The alert of the query <b>{{.Name}}</b> has been acknowledged by {{.By}} at {{.At}}.
+It won't be notified again until it ends.</p>
+{{else}}<p>The query <b>{{.Name}}</b> is in alert.</p>
+<form method="post">
+<input type="text" name="by" placeholder="your name">
+<input type="submit" value="Acknowledge">
+</form>
+{{end}}</body>
+</html>
+`
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_Ack(t *testing.T) {
+	var s queryStats
+
+	eslog.InitSilent()
+	id := startAlert("q1")
+	assert.Equal(t, 16, len(id))
+	assert.NotEqual(t, id, startAlert("q2"))
+	assert.False(t, isAcked("q1"))
+	setAckStats(&s, "q1")
+	assert.Equal(t, id, s.AlertId)
+	assert.Equal(t, "None", s.AckBy)
+
+	//acknowledged once
+	name, err := ackAlert(id, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "q1", name)
+	_, err = ackAlert(id, "bob")
+	assert.Nil(t, err)
+	assert.True(t, isAcked("q1"))
+	assert.False(t, isAcked("q2"))
+	setAckStats(&s, "q1")
+	assert.Equal(t, "alice", s.AckBy)
+	assert.NotEqual(t, "None", s.AckAt)
+
+	//the link of an alert ended doesn't work anymore
+	endAlert("q1")
+	assert.False(t, isAcked("q1"))
+	_, err = ackAlert(id, "alice")
+	assert.NotNil(t, err)
+	setAckStats(&s, "q1")
+	assert.Equal(t, "None", s.AlertId)
+	assert.Equal(t, "None", s.AckBy)
+
+	//by query, for the API
+	assert.NotNil(t, ackQuery("q1", "alice"))
+	assert.Nil(t, ackQuery("q2", "alice"))
+	assert.True(t, isAcked("q2"))
+	endAlert("q2")
+}
+
+func Test_AckLink(t *testing.T) {
+	config.G_Config.Config = &config.Config{Server_mode: true, Server_path: "/escheck"}
+	assert.Equal(t, "", getAckLink("42"))
+	config.G_Config.Config.Server_url = "http://eschecker.example.com:4242/"
+	assert.Equal(t, "http://eschecker.example.com:4242/escheck/ack/42", getAckLink("42"))
+	config.G_Config.Config.Server_mode = false
+	assert.Equal(t, "", getAckLink("42"))
+}
+
+func Test_AckHandler(t *testing.T) {
+	eslog.InitSilent()
+	ts := httptest.NewServer(http.HandlerFunc(newAckHandler("/escheck" + ACK_PATH)))
+	defer ts.Close()
+	id := startAlert("q1")
+	defer endAlert("q1")
+
+	//opening the link doesn't acknowledge the alert
+	res, err := http.Get(ts.URL + "/escheck/ack/" + id)
+	assert.Nil(t, err)
+	page, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, strings.Contains(string(page), `value="Acknowledge"`))
+	assert.False(t, isAcked("q1"))
+
+	res, err = http.PostForm(ts.URL+"/escheck/ack/"+id, url.Values{"by": {"alice"}})
+	assert.Nil(t, err)
+	page, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, strings.Contains(string(page), "acknowledged by alice"))
+	assert.True(t, isAcked("q1"))
+
+	res, err = http.PostForm(ts.URL+"/escheck/ack/unknown", nil)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
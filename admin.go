@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/esmail"
+	"github.com/amundi/escheck/esoutbox"
+	"github.com/amundi/escheck/esslack"
+	"html"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+** eschecker reports its own problems with the admin_actions of the yaml: a
+** query that can't start or is suspended, the cluster unreachable, the
+** notifications failing. Each problem is sent once, then once more when it is
+** solved.
+ */
+
+const (
+	//how often the cluster is checked
+	CLUSTER_CHECK_SCHEDULE = 1 * time.Minute
+	CLUSTER_CHECK_TIMEOUT  = 10 * time.Second
+	ADMIN_KEY_CLUSTER      = "cluster"
+	ADMIN_KEY_DELIVERY     = "delivery"
+)
+
+var g_admin = struct {
+	mail   *esmail.Mail
+	slack  *esslack.SlackMsg
+	active map[string]bool //problems already reported and not solved
+	sync.Mutex
+}{active: make(map[string]bool)}
+
+//sends the notifications, replaced in the tests
+var g_adminSend = sendAdminNotification
+
+func initAdmin() {
+	info := config.G_Config.Config.Admin_actions
+	for _, action := range info.List {
+		switch action {
+		case "email":
+			g_admin.mail = esmail.NewMail()
+			g_admin.mail.SetRecipients(info.Email.To)
+			g_admin.mail.SetCc(info.Email.Cc)
+			g_admin.mail.SetBcc(info.Email.Bcc)
+			g_admin.mail.SetReplyTo(info.Email.Reply_to)
+		case "slack":
+			g_admin.slack = esslack.NewSlackMsg("", info.Slack.User, info.Slack.Channel)
+			g_admin.slack.SetWebhook(info.Slack.Webhook)
+		default:
+			eslog.Error("%s : unknown admin action %s", os.Args[0], action)
+		}
+	}
+}
+
+func isAdmin() bool {
+	return g_admin.mail != nil || g_admin.slack != nil
+}
+
+// adminAlert reports a problem, if it is not already reported
+func adminAlert(key string, subject string, text string) {
+	g_admin.Lock()
+	if g_admin.active[key] {
+		g_admin.Unlock()
+		return
+	}
+	g_admin.active[key] = true
+	g_admin.Unlock()
+	g_adminSend(subject, text, false)
+}
+
+// adminRecovery reports that a problem is solved, if it was reported
+func adminRecovery(key string, subject string, text string) {
+	g_admin.Lock()
+	if !g_admin.active[key] {
+		g_admin.Unlock()
+		return
+	}
+	delete(g_admin.active, key)
+	g_admin.Unlock()
+	g_adminSend(subject, text, true)
+}
+
+func sendAdminNotification(subject string, text string, recovery bool) {
+	g_admin.Lock()
+	defer g_admin.Unlock()
+	if g_admin.mail != nil {
+		g_admin.mail.SetSubject(subject)
+		//the errors can hold anything, like the body of an answer
+		g_admin.mail.SetBody("<p>%s</p>", html.EscapeString(text))
+		g_admin.mail.Send()
+	}
+	if g_admin.slack != nil {
+		g_admin.slack.SetText("*" + subject + "*\n" + text)
+		if recovery {
+			g_admin.slack.SetColor(esslack.COLOR_RECOVERY)
+		} else {
+			g_admin.slack.SetColor(esslack.COLOR_ALERT)
+		}
+		g_admin.slack.Send()
+	}
+}
+
+/*
+** The problems reported
+ */
+
+func adminQueryFailed(name string, err error) {
+	adminAlert("start:"+name, "eschecker: query "+name+" can't start",
+		fmt.Sprintf("The query %s failed to start and won't be launched until eschecker restarts or the query is saved again through the API: %s", name, err.Error()))
+}
+
+func adminQuerySuspended(name string, err error, schedule time.Duration) {
+	adminAlert("suspended:"+name, "eschecker: query "+name+" suspended",
+		fmt.Sprintf("The query %s failed too many times and is now only tried every %s. Last error: %s", name, schedule, err.Error()))
+}
+
+func adminQueryResumed(name string) {
+	adminRecovery("suspended:"+name, "eschecker: query "+name+" resumed",
+		fmt.Sprintf("The query %s works again.", name))
+}
+
+// the results of a query are partial, if partial_results_notify
+func adminQueryDegraded(name string, err error) {
+	if isPartialNotify() {
+		adminAlert("degraded:"+name, "eschecker: query "+name+" degraded",
+			fmt.Sprintf("The results of the query %s are incomplete: %s", name, err.Error()))
+	}
+}
+
+func adminQueryComplete(name string) {
+	adminRecovery("degraded:"+name, "eschecker: query "+name+" complete",
+		fmt.Sprintf("The results of the query %s are complete again.", name))
+}
+
+// called by the outbox each time a notification fails
+func adminDeliveryFailure(origin string, dropped bool, err error) {
+	collectorDeliveryFailure(origin, dropped, err)
+	adminAlert(ADMIN_KEY_DELIVERY, "eschecker: notifications failing",
+		fmt.Sprintf("Notifications can't be delivered, they will be sent again later: %s", err.Error()))
+}
+
+// called by the outbox when a notification is delivered after failing
+func adminDeliverySuccess(origin string) {
+	historyDeliverySuccess(origin)
+	if esoutbox.Pending() == 0 {
+		adminRecovery(ADMIN_KEY_DELIVERY, "eschecker: notifications delivered",
+			"All the notifications that failed have been delivered.")
+	}
+}
+
+// watchCluster checks regularly that the cluster answers
+func watchCluster(c *cluster) {
+	for {
+		checkCluster(c)
+		time.Sleep(CLUSTER_CHECK_SCHEDULE)
+	}
+}
+
+func checkCluster(c *cluster) {
+	addr := config.G_Config.Config.Cluster_addr
+	ctx, cancel := context.WithTimeout(context.Background(), CLUSTER_CHECK_TIMEOUT)
+	defer cancel()
+	if _, err := c.performRequest(ctx, "GET", "/", nil, nil); err != nil {
+		eslog.Error("%s : cluster unreachable, %s", os.Args[0], err.Error())
+		adminAlert(ADMIN_KEY_CLUSTER, "eschecker: cluster unreachable",
+			fmt.Sprintf("The cluster %s can't be reached: %s", addr, err.Error()))
+	} else {
+		adminRecovery(ADMIN_KEY_CLUSTER, "eschecker: cluster reachable",
+			fmt.Sprintf("The cluster %s can be reached again.", addr))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type adminSent struct {
+	subject  string
+	recovery bool
+}
+
+func Test_Admin(t *testing.T) {
+	var sent []adminSent
+
+	active := g_admin.active
+	g_admin.active = make(map[string]bool)
+	t.Cleanup(func() { g_admin.active = active })
+	g_adminSend = func(subject string, text string, recovery bool) {
+		sent = append(sent, adminSent{subject, recovery})
+	}
+	defer func() { g_adminSend = sendAdminNotification }()
+
+	//not reported, nothing to recover
+	adminQueryResumed("q1")
+	assert.Equal(t, 0, len(sent))
+
+	//reported only once
+	adminQuerySuspended("q1", errors.New("timeout"), time.Hour)
+	adminQuerySuspended("q1", errors.New("timeout"), time.Hour)
+	adminQuerySuspended("q2", errors.New("timeout"), time.Hour)
+	assert.Equal(t, []adminSent{
+		{"eschecker: query q1 suspended", false},
+		{"eschecker: query q2 suspended", false},
+	}, sent)
+
+	//recovered once, and can be reported again
+	adminQueryResumed("q1")
+	adminQueryResumed("q1")
+	adminQuerySuspended("q1", errors.New("timeout"), time.Hour)
+	assert.Equal(t, []adminSent{
+		{"eschecker: query q1 suspended", false},
+		{"eschecker: query q2 suspended", false},
+		{"eschecker: query q1 resumed", true},
+		{"eschecker: query q1 suspended", false},
+	}, sent)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+** Management API of the server, in json, under server_path/api/queries:
+**   GET    /api/queries                list the queries, their config and status
+**   GET    /api/queries/{name}         one query
+**   PUT    /api/queries/{name}         create or replace an autoquery, see rules.go
+**   DELETE /api/queries/{name}         delete an autoquery created by the API
+**   GET    /api/queries/{name}/history the last alerts of the query, see history.go
+**   POST   /api/queries/{name}/{op}    run, pause, resume, mute, unmute or ack it
+** It is protected by the basic authentication of the server. Without it, the
+** API is read only: PUT, DELETE and POST are forbidden.
+ */
+
+const (
+	API_PATH = "/api/queries"
+	//max size of a query sent to the API
+	API_MAX_BODY = 1 << 20
+)
+
+// queryStatus is what the API gives for a query. The config is only known for
+// the running queries.
+type queryStatus struct {
+	Name    string       `json:"name"`
+	Managed bool         `json:"managed"` //created by the API
+	Running bool         `json:"running"`
+	Paused  bool         `json:"paused"`
+	Muted   bool         `json:"muted"`
+	Config  *queryConfig `json:"config,omitempty"`
+	Stats   queryStats   `json:"stats"`
+}
+
+type apiError struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+var g_apiOperations = map[string]func(*queryControl, *http.Request) error{
+	"run":    func(c *queryControl, r *http.Request) error { c.run(); return nil },
+	"pause":  func(c *queryControl, r *http.Request) error { c.pause(); return nil },
+	"resume": func(c *queryControl, r *http.Request) error { c.resume(); return nil },
+	"mute":   func(c *queryControl, r *http.Request) error { c.setMuted(true); return nil },
+	"unmute": func(c *queryControl, r *http.Request) error { c.setMuted(false); return nil },
+	"ack":    func(c *queryControl, r *http.Request) error { return ackQuery(c.name, getAckUser(r)) },
+}
+
+// newAPIHandler gives the handler of the API, under prefix
+func newAPIHandler(prefix string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var parts []string
+
+		if r.Method != "GET" && !IsServerAuthentication() {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "read only API, set server_login and server_password to change the queries"})
+			return
+		}
+		if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"); rest != "" {
+			parts = strings.Split(rest, "/")
+		}
+		switch len(parts) {
+		case 0:
+			if checkMethod(w, r, "GET") {
+				writeJSON(w, http.StatusOK, getQueryStatuses())
+			}
+		case 1:
+			switch r.Method {
+			case "GET":
+				if status, ok := getQueryStatus(parts[0]); ok {
+					writeJSON(w, http.StatusOK, status)
+				} else {
+					writeJSON(w, http.StatusNotFound, apiError{Error: "unknown query " + parts[0]})
+				}
+			case "PUT":
+				doPut(w, r, parts[0])
+			case "DELETE":
+				doDelete(w, parts[0])
+			default:
+				w.Header().Set("Allow", "GET, PUT, DELETE")
+				writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use GET, PUT or DELETE"})
+			}
+		case 2:
+			if parts[1] == "history" {
+				if checkMethod(w, r, "GET") {
+					doHistory(w, parts[0])
+				}
+			} else if checkMethod(w, r, "POST") {
+				doOperation(w, r, parts[0], parts[1])
+			}
+		default:
+			writeJSON(w, http.StatusNotFound, apiError{Error: "unknown path " + r.URL.Path})
+		}
+	}
+}
+
+// doPut creates or replaces a query of the rules file
+func doPut(w http.ResponseWriter, r *http.Request, name string) {
+	if !checkRulesAccess(w, name) {
+		return
+	}
+	source, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	info, err := decodeRule(source)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "wrong query, " + err.Error()})
+		return
+	}
+	a, errs := checkRule(name, info)
+	if len(errs) > 0 {
+		ret := apiError{Error: "invalid query " + name}
+		for _, err := range errs {
+			ret.Errors = append(ret.Errors, err.Error())
+		}
+		writeJSON(w, http.StatusBadRequest, ret)
+		return
+	}
+	_, exists := getQueryStatus(name)
+	if err = putRule(name, info, a); err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "failed to save the query, " + err.Error()})
+		return
+	}
+	code := http.StatusCreated
+	if exists {
+		code = http.StatusOK
+	}
+	status, _ := getQueryStatus(name)
+	writeJSON(w, code, status)
+}
+
+func doDelete(w http.ResponseWriter, name string) {
+	if !checkRulesAccess(w, name) {
+		return
+	}
+	if !isManaged(name) {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "unknown query " + name})
+		return
+	}
+	if err := deleteRule(name); err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "failed to delete the query, " + err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkRulesAccess tells if the query can be changed by the API: only the
+// ones of the rules file can
+func checkRulesAccess(w http.ResponseWriter, name string) bool {
+	if !isRules() {
+		writeJSON(w, http.StatusForbidden, apiError{Error: "the queries can't be changed, rules_file is not set"})
+		return false
+	}
+	if _, exists := getQueryInfo(name); exists && !isManaged(name) {
+		writeJSON(w, http.StatusConflict, apiError{Error: "the query " + name + " is defined in the config file"})
+		return false
+	}
+	return true
+}
+
+func doHistory(w http.ResponseWriter, name string) {
+	if _, ok := getQueryStatus(name); !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "unknown query " + name})
+		return
+	}
+	writeJSON(w, http.StatusOK, getHistory(name))
+}
+
+func doOperation(w http.ResponseWriter, r *http.Request, name string, op string) {
+	operation, ok := g_apiOperations[op]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "unknown operation " + op})
+		return
+	}
+	if _, ok := getQueryStatus(name); !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "unknown query " + name})
+		return
+	}
+	control := getControl(name)
+	if control == nil {
+		writeJSON(w, http.StatusConflict, apiError{Error: "the query " + name + " is not running"})
+		return
+	}
+	if err := operation(control, r); err != nil {
+		writeJSON(w, http.StatusConflict, apiError{Error: err.Error()})
+		return
+	}
+	status, _ := getQueryStatus(name)
+	writeJSON(w, http.StatusOK, status)
+}
+
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use " + method})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	content, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		http.Error(w, "Error while encoding the response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(content)
+}
+
+func getQueryStatus(name string) (queryStatus, bool) {
+	stats.RLock()
+	s, ok := stats.statsMap[name]
+	stats.RUnlock()
+	if !ok {
+		return queryStatus{}, false
+	}
+	ret := queryStatus{Name: name, Managed: isManaged(name), Stats: s}
+	if control := getControl(name); control != nil {
+		ret.Running = true
+		ret.Paused = control.isPaused()
+		ret.Muted = control.isMuted()
+		ret.Config = control.getConfig()
+	}
+	return ret, true
+}
+
+// getQueryStatuses gives all the queries, sorted by name
+func getQueryStatuses() []queryStatus {
+	var names []string
+
+	stats.RLock()
+	for name := range stats.statsMap {
+		names = append(names, name)
+	}
+	stats.RUnlock()
+	sort.Strings(names)
+	ret := make([]queryStatus, 0, len(names))
+	for _, name := range names {
+		if status, ok := getQueryStatus(name); ok {
+			ret = append(ret, status)
+		}
+	}
+	return ret
+}
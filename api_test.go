@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/queries"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func apiRequest(t *testing.T, ts *httptest.Server, method string, path string, ret interface{}) int {
+	req, err := http.NewRequest(method, ts.URL+path, nil)
+	assert.Nil(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	if ret != nil {
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(ret))
+	}
+	return res.StatusCode
+}
+
+func Test_API(t *testing.T) {
+	var list []queryStatus
+	var status queryStatus
+	var apiErr apiError
+
+	eslog.InitSilent()
+	config.G_Config.Config = &config.Config{Server_login: "admin", Server_password: "secret"}
+	stats.statsMap = map[string]queryStats{
+		"running": {IsUp: true, Tries: 3, LastAlert: "None", LastError: "None"},
+		"failed":  {IsUp: false, LastAlert: "None", LastError: "None"},
+	}
+	control := newQueryControl("running", queryConfig{Schedule: "1m0s", Timeout: "30s", Actions: []string{"email"}}, time.Second)
+	registerControl(control)
+	defer func() {
+		g_controls.Lock()
+		delete(g_controls.list, "running")
+		g_controls.Unlock()
+	}()
+	prefix := "/escheck" + API_PATH
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix, newAPIHandler(prefix))
+	mux.HandleFunc(prefix+"/", newAPIHandler(prefix))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	//list, sorted by name, with the config of the running queries
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "GET", prefix, &list))
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, "failed", list[0].Name)
+	assert.False(t, list[0].Running)
+	assert.Nil(t, list[0].Config)
+	assert.Equal(t, "running", list[1].Name)
+	assert.Equal(t, "1m0s", list[1].Config.Schedule)
+	assert.Equal(t, 3, list[1].Stats.Tries)
+
+	//one query
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "GET", prefix+"/running", &status))
+	assert.True(t, status.Running)
+	assert.Equal(t, http.StatusNotFound, apiRequest(t, ts, "GET", prefix+"/unknown", &apiErr))
+	assert.Equal(t, "unknown query unknown", apiErr.Error)
+
+	//operations
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "POST", prefix+"/running/pause", &status))
+	assert.True(t, status.Paused)
+	assert.True(t, control.isPaused())
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "POST", prefix+"/running/mute", &status))
+	assert.True(t, status.Muted)
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "POST", prefix+"/running/resume", &status))
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "POST", prefix+"/running/unmute", &status))
+	assert.False(t, status.Paused)
+	assert.False(t, status.Muted)
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "POST", prefix+"/running/run", nil))
+	assert.True(t, control.takeRunNow())
+
+	//the current alert is acknowledged by the user of the request
+	assert.Equal(t, http.StatusConflict, apiRequest(t, ts, "POST", prefix+"/running/ack", &apiErr))
+	assert.Equal(t, "the query running is not in alert", apiErr.Error)
+	startAlert("running")
+	defer endAlert("running")
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "POST", prefix+"/running/ack", nil))
+	assert.True(t, isAcked("running"))
+
+	//the alerts of the query
+	var events []alertEvent
+	initHistoryForTests(t, "", 0)
+	config.G_Config.Config.Server_login = "admin"
+	config.G_Config.Config.Server_password = "secret"
+	historyStart("running", "42", 7, []string{"email"}, false)
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "GET", prefix+"/running/history", &events))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, int64(7), events[0].Hits)
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "GET", prefix+"/failed/history", &events))
+	assert.Equal(t, 0, len(events))
+	assert.Equal(t, http.StatusNotFound, apiRequest(t, ts, "GET", prefix+"/unknown/history", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, apiRequest(t, ts, "POST", prefix+"/running/history", nil))
+
+	//errors
+	assert.Equal(t, http.StatusMethodNotAllowed, apiRequest(t, ts, "GET", prefix+"/running/run", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, apiRequest(t, ts, "POST", prefix, nil))
+	assert.Equal(t, http.StatusNotFound, apiRequest(t, ts, "POST", prefix+"/running/explode", nil))
+	assert.Equal(t, http.StatusNotFound, apiRequest(t, ts, "POST", prefix+"/unknown/run", nil))
+	assert.Equal(t, http.StatusConflict, apiRequest(t, ts, "POST", prefix+"/failed/run", &apiErr))
+	assert.Equal(t, "the query failed is not running", apiErr.Error)
+	assert.Equal(t, http.StatusNotFound, apiRequest(t, ts, "GET", prefix+"/a/b/c", nil))
+
+	//read only without the authentication of the server
+	config.G_Config.Config = &config.Config{}
+	assert.Equal(t, http.StatusForbidden, apiRequest(t, ts, "POST", prefix+"/running/pause", &apiErr))
+	assert.False(t, control.isPaused())
+	assert.Equal(t, http.StatusForbidden, apiRequest(t, ts, "DELETE", prefix+"/running", nil))
+	assert.Equal(t, http.StatusOK, apiRequest(t, ts, "GET", prefix+"/running", &status))
+}
+
+func apiSend(t *testing.T, ts *httptest.Server, method string, path string, body string, ret interface{}) int {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	assert.Nil(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	if ret != nil {
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(ret))
+	}
+	return res.StatusCode
+}
+
+func Test_APIRules(t *testing.T) {
+	var status queryStatus
+	var apiErr apiError
+
+	setRuleLaunch(func(q queries.Query, name string, env *Env, control *queryControl) {
+		close(control.done)
+	})
+	defer setRuleLaunch(launchQuery)
+	e, dir := initRulesForTests(t, "")
+	defer os.RemoveAll(dir)
+	assert.Nil(t, e.loadRules())
+	config.G_Config.Config.Server_login = "admin"
+	config.G_Config.Config.Server_password = "secret"
+	stats.statsMap = map[string]queryStats{"fromyml": newQueryStats()}
+	prefix := "/escheck" + API_PATH
+	ts := httptest.NewServer(http.HandlerFunc(newAPIHandler(prefix)))
+	defer ts.Close()
+
+	//created, then replaced
+	assert.Equal(t, http.StatusCreated, apiSend(t, ts, "PUT", prefix+"/errors", testRule, &status))
+	assert.Equal(t, "errors", status.Name)
+	assert.True(t, status.Managed)
+	assert.Equal(t, http.StatusOK, apiSend(t, ts, "PUT", prefix+"/errors", testRuleJSON, &status))
+	info, _ := getQueryInfo("errors")
+	assert.Equal(t, "5m", info.Schedule)
+
+	//refused
+	assert.Equal(t, http.StatusBadRequest, apiSend(t, ts, "PUT", prefix+"/errors", "schedule: pouet", &apiErr))
+	assert.Equal(t, "invalid query errors", apiErr.Error)
+	assert.True(t, len(apiErr.Errors) > 0)
+	assert.Equal(t, http.StatusBadRequest, apiSend(t, ts, "PUT", prefix+"/errors", "{{", nil))
+	assert.Equal(t, http.StatusConflict, apiSend(t, ts, "PUT", prefix+"/fromyml", testRule, nil))
+	assert.Equal(t, http.StatusConflict, apiSend(t, ts, "DELETE", prefix+"/fromyml", "", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, apiSend(t, ts, "POST", prefix+"/errors", "", nil))
+
+	//deleted
+	assert.Equal(t, http.StatusNoContent, apiSend(t, ts, "DELETE", prefix+"/errors", "", nil))
+	assert.Equal(t, http.StatusNotFound, apiSend(t, ts, "DELETE", prefix+"/errors", "", nil))
+	assert.Equal(t, http.StatusNotFound, apiSend(t, ts, "GET", prefix+"/errors", "", nil))
+
+	//without rules file
+	g_rules.file = ""
+	assert.Equal(t, http.StatusForbidden, apiSend(t, ts, "PUT", prefix+"/errors", testRule, nil))
+}
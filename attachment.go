@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/olivere/elastic.v2"
+)
+
+/*
+** Formatting of the documents found by a query, to attach them to the alert
+** emails as a CSV or a NDJSON file (one json document per line).
+ */
+
+const (
+	ATTACH_CSV  = "csv"
+	ATTACH_JSON = "json"
+)
+
+func isAttachFormat(format string) bool {
+	return format == ATTACH_CSV || format == ATTACH_JSON
+}
+
+// getAttachment gives the file name, content type and content of the attachment
+func getAttachment(name string, format string, hits []*elastic.SearchHit, fields []string) (string, string, []byte, error) {
+	switch format {
+	case ATTACH_CSV:
+		content, err := formatCSV(hits, fields)
+		return name + ".csv", "text/csv", content, err
+	case ATTACH_JSON:
+		content, err := formatNDJSON(hits)
+		return name + ".json", "application/x-ndjson", content, err
+	}
+	return "", "", nil, fmt.Errorf("unknown attachment format %s, only: csv, json", format)
+}
+
+// formatCSV writes one line per document, with the given fields as columns. The
+// fields can be nested, like "http.response.status". Without fields, the
+// columns are the id and the first level fields of the documents.
+func formatCSV(hits []*elastic.SearchHit, fields []string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	columns, rows := getTable(hits, fields)
+	w := csv.NewWriter(&buf)
+	if err := w.Write(columns); err != nil {
+		return nil, err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), w.Error()
+}
+
+func formatNDJSON(hits []*elastic.SearchHit) ([]byte, error) {
+	var buf bytes.Buffer
+
+	for _, hit := range hits {
+		if hit.Source == nil {
+			continue
+		}
+		if err := json.Compact(&buf, *hit.Source); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"testing"
+)
+
+func newHitForTests(id string, source string) *elastic.SearchHit {
+	raw := json.RawMessage(source)
+	return &elastic.SearchHit{Id: id, Source: &raw}
+}
+
+func TestFormatCSV(t *testing.T) {
+	hits := []*elastic.SearchHit{
+		newHitForTests("1", `{"status": 500, "host": {"name": "srv1"}, "msg": "boom, again"}`),
+		newHitForTests("2", `{"status": 404, "host.name": "srv2", "tags": ["a", "b"]}`),
+	}
+	content, err := formatCSV(hits, []string{"_id", "status", "host.name", "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, "_id,status,host.name,missing\n1,500,srv1,\n2,404,srv2,\n", string(content))
+
+	//columns from the documents
+	content, err = formatCSV(hits, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "_id,host,host.name,msg,status,tags\n"+
+		`1,"{""name"":""srv1""}",srv1,"boom, again",500,`+"\n"+
+		`2,,srv2,,404,"[""a"",""b""]"`+"\n", string(content))
+}
+
+func TestFormatNDJSON(t *testing.T) {
+	hits := []*elastic.SearchHit{
+		newHitForTests("1", `{"status": 500,
+			"msg": "boom"}`),
+		newHitForTests("2", `{"status": 404}`),
+	}
+	content, err := formatNDJSON(hits)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"status\":500,\"msg\":\"boom\"}\n{\"status\":404}\n", string(content))
+}
+
+func TestGetAttachment(t *testing.T) {
+	hits := []*elastic.SearchHit{newHitForTests("1", `{"status": 500}`)}
+	name, contentType, _, err := getAttachment("myquery", ATTACH_CSV, hits, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "myquery.csv", name)
+	assert.Equal(t, "text/csv", contentType)
+	name, _, content, err := getAttachment("myquery", ATTACH_JSON, hits, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "myquery.json", name)
+	assert.Equal(t, "{\"status\":500}\n", string(content))
+	_, _, _, err = getAttachment("myquery", "xml", hits, nil)
+	assert.NotNil(t, err)
+}
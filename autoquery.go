@@ -2,18 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/amundi/escheck/config"
 	"github.com/amundi/escheck/eslog"
 	"github.com/amundi/escheck/esmail"
 	"github.com/amundi/escheck/esslack"
 	"gopkg.in/olivere/elastic.v2"
+	"html"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type mailer struct {
 	body         string
 	AlertMail    *esmail.Mail
 	EndAlertMail *esmail.Mail
+	//attachment of the documents found
+	attach       string
+	attachFields []string
+	attachMax    int
 }
 
 type slacker struct {
@@ -22,63 +31,235 @@ type slacker struct {
 }
 
 type autoQuery struct {
-	name      string //the name of the query, to get from the yml
-	limit     int    //the limit for checkcondition
+	name      string        //the name of the query, to get from the yml
+	info      *config.Query //the config of a query created by the API
+	limit     int           //the limit for checkcondition
 	queryInfo *config.QueryInfo
+	//fields of the documents displayed as a table in the notifications
+	displayFields []string
+	fetchedFields []string
+	query         elastic.Query
+	cluster       *cluster //to get more documents than the search gives
 	//integrations
 	actionList []string //the list of actions. Ex, ["slack", "email"]
 	mail       *mailer  //pointer rather than a struct in case of action doesn't exist
 	slack      *slacker
+	index      *indexer //writes the alerts in the cluster
+	digest     *digest  //if set, the alerts are sent in a periodic summary
+	alertId    string   //the current alert
+	ackLink    string   //link to acknowledge the current alert, if the server is known
+	//routing of the alerts, see routing.go
+	severity  string
+	receivers []*autoQuery //notified in addition to the actions
+	receiver  string       //name of the receiver, if the autoquery is one
+	//notifies more receivers if the alert is not acknowledged, see escalation.go
+	escalation *escalation
+	//the config is only checked: the shared digests aren't created
+	checkOnly bool
 }
 
 func (a *autoQuery) SetQueryConfig(c config.ManualQueryList) bool {
 	//autoqueries don't need the manualquery list, parameter stay unused
-	info, ok := config.G_Config.Config.QueryList[a.name]
-	if !ok {
-		eslog.Error("%s : failed to get query configuration", a.name)
+	if err := a.setConfig(); err != nil {
+		useDigests(a.name, nil)
+		eslog.Error("%s : %s", a.name, err.Error())
 		return true
 	}
-	a.actionList = info.Actions.List
-	if len(a.actionList) == 0 {
-		eslog.Warning("%s : No action defined", a.name)
+	useDigests(a.name, a.getDigests())
+	return false
+}
+
+// getDigests gives the digests of the query and of its receivers
+func (a *autoQuery) getDigests() []*digest {
+	var ret []*digest
+
+	if a.digest != nil {
+		ret = append(ret, a.digest)
+	}
+	receivers := append([]*autoQuery{}, a.receivers...)
+	if a.escalation != nil {
+		for _, tier := range a.escalation.tiers {
+			receivers = append(receivers, tier.receivers...)
+		}
+	}
+	for _, r := range receivers {
+		ret = append(ret, r.getDigests()...)
+	}
+	return ret
+}
+
+// getInfo gives the config of the query: the one it was created with by the
+// API, else the one of the yml
+func (a *autoQuery) getInfo() (config.Query, bool) {
+	if a.info != nil {
+		return *a.info, true
+	}
+	return getQueryInfo(a.name)
+}
+
+// setConfig initializes the query and its actions, and tells what is wrong
+// in its config
+func (a *autoQuery) setConfig() error {
+	info, ok := a.getInfo()
+	if !ok {
+		return errors.New("failed to get query configuration")
+	}
+	severity, err := getSeverity(info.Severity)
+	if err != nil {
+		return err
 	}
+	a.severity = severity
+	a.actionList = info.Actions.List
 	for _, val := range a.actionList {
 		//loop to initialize the actions
 		switch val {
 		case "email":
 			if len(info.Actions.Email.To) == 0 {
-				eslog.Error("%s : No recipients defined for email action", a.name)
-				return true
+				return errors.New("No recipients defined for email action")
+			}
+			if info.Actions.Email.Attach != "" && !isAttachFormat(info.Actions.Email.Attach) {
+				return fmt.Errorf("unknown attachment format %s, only: csv, json", info.Actions.Email.Attach)
 			}
 			a.initMailerForAutoQuery(&info)
 		case "slack":
 			if len(info.Actions.Slack.Channel) == 0 {
-				eslog.Error("%s : No channels defined for slack action", a.name)
-				return true
+				return errors.New("No channels defined for slack action")
 			}
 			a.initSlackForAutoQuery(info.Actions.Slack)
+		case "index":
+			index, err := newIndexer(info.Actions.Index)
+			if err != nil {
+				return err
+			}
+			a.index = index
+		}
+	}
+	if info.Digest != "" {
+		period, err := time.ParseDuration(info.Digest)
+		if err != nil || period <= 0 {
+			return fmt.Errorf("wrong digest period %s", info.Digest)
+		}
+		if a.checkOnly {
+			a.digest = newDigest(period, &info)
+		} else {
+			a.digest = getDigest(a.name, period, &info)
+		}
+	}
+	if a.receiver == "" {
+		if err := a.initReceivers(&info); err != nil {
+			return err
+		}
+		a.escalation = nil
+		if info.Escalation != "" {
+			if a.escalation, err = a.newEscalation(info.Escalation, &info); err != nil {
+				return err
+			}
+		}
+		if len(a.actionList) == 0 && len(a.receivers) == 0 && a.escalation == nil {
+			eslog.Warning("%s : No action defined", a.name)
 		}
 	}
 	a.limit = info.Query.Limit
 	a.queryInfo = &info.Query
+	a.displayFields = info.Query.Display_fields
+	a.fetchedFields = getFetchedFields(&info)
+	if isCheckType(info.Query.Type) {
+		//each problem found by a check is a hit
+		if a.limit == 0 {
+			a.limit = 1
+		}
+		if len(a.displayFields) == 0 {
+			a.displayFields = g_checkColumns
+		}
+	}
+	return nil
+}
+
+// needsDocuments tells if the actions display the documents found. If not, the
+// query only counts them.
+func (a *autoQuery) needsDocuments() bool {
+	if a.queryInfo == nil || a.queryInfo.NbDocs <= 0 {
+		return false
+	}
+	//the receivers notify even if the actions of the query are in digest mode
+	for _, r := range a.receivers {
+		if r.needsDocuments() {
+			return true
+		}
+	}
+	if a.escalation != nil {
+		for _, tier := range a.escalation.tiers {
+			for _, r := range tier.receivers {
+				if r.needsDocuments() {
+					return true
+				}
+			}
+		}
+	}
+	if a.digest != nil {
+		return false
+	}
+	for _, action := range a.actionList {
+		switch action {
+		case "email":
+			//excerpt of the results or attachment
+			return true
+		case "slack":
+			if len(a.displayFields) > 0 {
+				return true
+			}
+		case "index":
+			//ids of the documents found
+			return true
+		}
+	}
 	return false
 }
 
 func (a *autoQuery) BuildQuery() (elastic.Query, error) {
-	return computeQuery(a.queryInfo)
+	var err error
+
+	//checks don't search, but their thresholds are checked here
+	if a.queryInfo != nil && isCheckType(a.queryInfo.Type) {
+		_, err = newChecker(a.queryInfo)
+		return nil, err
+	}
+	a.query, err = computeQuery(a.queryInfo)
+	return a.query, err
 }
 
 func (a *autoQuery) CheckCondition(search *elastic.SearchResult) bool {
-	return search.Hits.TotalHits >= int64(a.limit)
+	ret := search.Hits.TotalHits >= int64(a.limit)
+	if ret && a.digest != nil {
+		a.digest.observe(a.name, search.Hits.TotalHits)
+	}
+	return ret
 }
 
 func (a *autoQuery) DoAction(search *elastic.SearchResult) error {
+	if a.index != nil {
+		a.index.writeAlert(a, search)
+	}
+	for _, r := range a.receivers {
+		r.alertId, r.ackLink = a.alertId, a.ackLink
+		r.DoAction(search)
+	}
+	if a.digest != nil {
+		a.digest.addAlert(a.name, search.Hits.TotalHits)
+		return nil
+	}
 
 	for i := 0; i < len(a.actionList); i++ {
 		switch a.actionList[i] {
 		case "email":
-			//pretty-format the results if they exists, set them in the body with base text
-			if size := len(search.Hits.Hits); size > 0 {
+			if a.mail.attach != "" {
+				a.attachResults(search)
+			} else if len(search.Hits.Hits) > 0 && len(a.displayFields) > 0 {
+				columns, rows := getTable(search.Hits.Hits, a.displayFields)
+				a.mail.AlertMail.SetBody("<p>%s</p><p>Here is an excerpt of results :</p>%s",
+					a.mail.body, esmail.FormatTableHTML(columns, rows))
+			} else if size := len(search.Hits.Hits); size > 0 {
+				//pretty-format the results if they exists, set them in the body with base text
 				res := make([]*json.RawMessage, size)
 				for i, hit := range search.Hits.Hits {
 					res[i] = hit.Source
@@ -90,16 +271,69 @@ func (a *autoQuery) DoAction(search *elastic.SearchResult) error {
 				//no results to add, just send the m.text
 				a.mail.AlertMail.SetBody("<p>%s</p>", a.mail.body)
 			}
+			if a.ackLink != "" {
+				a.mail.AlertMail.AddToBody("<p><a href=\"%s\">Acknowledge this alert</a> to stop the repeated notifications.</p>",
+					html.EscapeString(a.ackLink))
+			}
 			a.mail.AlertMail.Send()
 			a.mail.AlertMail.ResetBody()
+			a.mail.AlertMail.ResetAttachments()
 		case "slack":
+			a.slack.msg.ResetFields()
+			a.slack.msg.AddField("Query", a.name)
+			a.slack.msg.AddField("Severity", a.severity)
+			a.slack.msg.AddField("Hits", strconv.FormatInt(search.Hits.TotalHits, 10))
+			if len(search.Hits.Hits) > 0 && len(a.displayFields) > 0 {
+				a.slack.msg.SetPreformatted(esslack.FormatTable(getTable(search.Hits.Hits, a.displayFields)))
+			} else {
+				a.slack.msg.SetPreformatted("")
+			}
+			if a.ackLink != "" {
+				a.slack.msg.AddField("Acknowledge", "<"+a.ackLink+"|stop the repeated notifications>")
+			}
 			a.slack.msg.Send()
 		}
 	}
 	return nil
 }
 
+// attachResults puts the documents found in a file joined to the alert mail, and
+// a summary in the body
+func (a *autoQuery) attachResults(search *elastic.SearchResult) {
+	hits := search.Hits.Hits
+	if a.mail.attachMax > len(hits) && search.Hits.TotalHits > int64(len(hits)) && a.query != nil {
+		body := getSearchBody(a.query, a.queryInfo.SortBy, a.queryInfo.SortOrder == "ASC", a.fetchedFields)
+		scrolled, err := scrollDocuments(a.cluster, a.queryInfo.Index, body, a.mail.attachMax)
+		if err != nil {
+			eslog.Warning("%s : failed to get more documents to attach, %s", a.name, err.Error())
+		} else {
+			hits = scrolled
+		}
+	}
+	if len(hits) == 0 {
+		a.mail.AlertMail.SetBody("<p>%s</p><p>%d documents found.</p>", a.mail.body, search.Hits.TotalHits)
+		return
+	}
+	name, contentType, content, err := getAttachment(a.name, a.mail.attach, hits, a.mail.attachFields)
+	if err != nil {
+		eslog.Error("%s : failed to create the attachment, %s", a.name, err.Error())
+		a.mail.AlertMail.SetBody("<p>%s</p><p>%d documents found.</p>", a.mail.body, search.Hits.TotalHits)
+		return
+	}
+	a.mail.AlertMail.AddAttachment(name, contentType, content)
+	a.mail.AlertMail.SetBody("<p>%s</p><p>%d documents found, %d of them are attached in %s.</p>",
+		a.mail.body, search.Hits.TotalHits, len(hits), name)
+}
+
 func (a *autoQuery) OnAlertEnd() error {
+	for _, r := range a.receivers {
+		r.alertId = a.alertId
+		r.OnAlertEnd()
+	}
+	//the recovery is in the digest, see recordEnd
+	if a.digest != nil {
+		return nil
+	}
 	for i := 0; i < len(a.actionList); i++ {
 		switch a.actionList[i] {
 		case "email":
@@ -111,6 +345,24 @@ func (a *autoQuery) OnAlertEnd() error {
 	return nil
 }
 
+// recordEnd writes the end of the alert in the index and the digest, with or
+// without end message, for the query and the receivers it notified
+func (a *autoQuery) recordEnd() {
+	if a.index != nil {
+		a.index.write(a, INDEX_END, a.alertId, nil)
+	}
+	if a.digest != nil {
+		a.digest.addRecovery(a.name)
+	}
+	for _, r := range a.receivers {
+		r.alertId = a.alertId
+		r.recordEnd()
+	}
+	if a.escalation != nil {
+		a.escalation.recordEnd()
+	}
+}
+
 // getAutoQueryList gets the list of autoqueries from YAML (not manual queries)
 func getAutoQueryList(list map[string]config.Query) (ret []string) {
 	ret = []string{}
@@ -138,17 +390,49 @@ func (a *autoQuery) initMailerForAutoQuery(info *config.Query) {
 	a.mail.AlertMail = esmail.NewMail()
 	a.mail.EndAlertMail = esmail.NewMail()
 	a.mail.body = info.Actions.Email.Text
-	a.mail.AlertMail.SetSubject(info.Actions.Email.Title)
+	a.mail.attach = info.Actions.Email.Attach
+	a.mail.attachFields = info.Actions.Email.Attach_fields
+	if len(a.mail.attachFields) == 0 {
+		a.mail.attachFields = info.Query.Display_fields
+	}
+	a.mail.attachMax = info.Actions.Email.Attach_max
+	//the subject of the queries without severity doesn't change
+	if info.Severity != "" {
+		a.mail.AlertMail.SetSubject("[" + strings.ToUpper(a.severity) + "] " + info.Actions.Email.Title)
+	} else {
+		a.mail.AlertMail.SetSubject(info.Actions.Email.Title)
+	}
 	a.mail.AlertMail.SetRecipients(info.Actions.Email.To)
+	a.mail.AlertMail.SetCc(info.Actions.Email.Cc)
+	a.mail.AlertMail.SetBcc(info.Actions.Email.Bcc)
+	a.mail.AlertMail.SetReplyTo(info.Actions.Email.Reply_to)
 	a.mail.AlertMail.SetFrom(a.name)
+	a.mail.AlertMail.SetOrigin(a.name)
 	a.mail.EndAlertMail.SetSubject("End of alert")
 	a.mail.EndAlertMail.SetRecipients(info.Actions.Email.To)
+	a.mail.EndAlertMail.SetCc(info.Actions.Email.Cc)
+	a.mail.EndAlertMail.SetBcc(info.Actions.Email.Bcc)
+	a.mail.EndAlertMail.SetReplyTo(info.Actions.Email.Reply_to)
 	a.mail.EndAlertMail.SetFrom(a.name)
+	a.mail.EndAlertMail.SetOrigin(a.name)
 	a.mail.EndAlertMail.SetBody("End of alert for query %s", a.name)
 }
 
 func (a *autoQuery) initSlackForAutoQuery(info config.Slack) {
 	a.slack = new(slacker)
 	a.slack.msg = esslack.NewSlackMsg(info.Text, info.User, info.Channel)
+	a.slack.msg.SetColor(esslack.COLOR_ALERT)
+	a.slack.msg.SetWebhook(info.Webhook)
+	a.slack.msg.SetOrigin(a.name)
 	a.slack.endMsg = esslack.NewSlackMsg(fmt.Sprintf("End of alert for %s", a.name), info.User, info.Channel)
+	a.slack.endMsg.SetColor(esslack.COLOR_RECOVERY)
+	a.slack.endMsg.SetWebhook(info.Webhook)
+	a.slack.endMsg.SetOrigin(a.name)
+	a.slack.endMsg.AddField("Query", a.name)
+	if info.Thread {
+		thread := esslack.NewThread()
+		a.slack.msg.SetThread(thread)
+		a.slack.endMsg.SetThread(thread)
+		a.slack.endMsg.SetEndOfThread(info.Update_resolved)
+	}
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/olivere/elastic.v2"
 	"testing"
+	"time"
 )
 
 func TestAutoQuery_SetQueryConfig(t *testing.T) {
@@ -30,6 +31,9 @@ func TestAutoQuery_SetQueryConfig(t *testing.T) {
 				},
 			},
 			"badtest": config.Query{},
+			"indextest": config.Query{
+				Actions: config.Actions{List: []string{"index"}, Index: config.Index{Name: "Alerts"}},
+			},
 		},
 	}
 	err := query.SetQueryConfig(c)
@@ -48,6 +52,11 @@ func TestAutoQuery_SetQueryConfig(t *testing.T) {
 	query.name = ""
 	err = query.SetQueryConfig(c)
 	assert.Equal(t, true, err)
+
+	//the names of the indices are in lower case
+	query.name = "indextest"
+	err = query.SetQueryConfig(c)
+	assert.Equal(t, true, err)
 }
 
 func TestAutoQuery_BuildQuery(t *testing.T) {
@@ -103,3 +112,41 @@ func TestAutoQuery_CheckCondition(t *testing.T) {
 	test.limit = 400
 	assert.Equal(t, false, test.CheckCondition(search))
 }
+
+func TestAutoQuery_NeedsDocuments(t *testing.T) {
+	test := new(autoQuery)
+	assert.Equal(t, false, test.needsDocuments())
+	test.queryInfo = &config.QueryInfo{NbDocs: 10}
+	assert.Equal(t, false, test.needsDocuments())
+
+	//slack only displays the documents as a table
+	test.actionList = []string{"slack"}
+	assert.Equal(t, false, test.needsDocuments())
+	test.displayFields = []string{"status"}
+	assert.Equal(t, true, test.needsDocuments())
+
+	//email always displays an excerpt
+	test.displayFields = nil
+	test.actionList = []string{"slack", "email"}
+	assert.Equal(t, true, test.needsDocuments())
+
+	//the index action writes the ids of the documents
+	test.actionList = []string{"index"}
+	assert.Equal(t, true, test.needsDocuments())
+
+	//nothing to display
+	test.queryInfo.NbDocs = 0
+	assert.Equal(t, false, test.needsDocuments())
+	test.queryInfo.NbDocs = 10
+	test.digest = new(digest)
+	assert.Equal(t, false, test.needsDocuments())
+
+	//a receiver notifying at once, with the actions of the query in digest mode
+	test.receivers = []*autoQuery{{queryInfo: test.queryInfo, actionList: []string{"email"}}}
+	assert.Equal(t, true, test.needsDocuments())
+
+	//or a receiver of the escalation
+	test.escalation = &escalation{tiers: []escalationTier{{time.Hour, test.receivers}}}
+	test.receivers = nil
+	assert.Equal(t, true, test.needsDocuments())
+}
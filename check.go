@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"gopkg.in/olivere/elastic.v2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+** Checks call the APIs of the cluster instead of searching documents. Each
+** problem found (a node with too much heap used, an index too big...) is
+** returned as a hit of a search result, so that the limit, the actions and the
+** display of the autoqueries work the same.
+ */
+
+const (
+	CHECK_CLUSTER_HEALTH = "cluster_health"
+	CHECK_NODE_STATS     = "node_stats"
+	CHECK_INDEX_STATS    = "index_stats"
+	CHECK_FRESHNESS      = "freshness"
+	//default thresholds
+	DEFAULT_HEALTH_STATUS   = "yellow"
+	DEFAULT_HEAP_PERCENT    = 85
+	DEFAULT_DISK_PERCENT    = 85 //the default low disk watermark of elasticsearch
+	DEFAULT_REJECTIONS      = 1
+	DEFAULT_FRESHNESS_FIELD = "@timestamp"
+)
+
+// columns of the problems, displayed by default in the notifications
+var g_checkColumns = []string{"name", "metric", "value", "threshold"}
+
+// levels of the health status
+var g_healthLevels = map[string]int{"green": 0, "yellow": 1, "red": 2}
+
+type problem struct {
+	Name      string      `json:"name"` //cluster, node or index
+	Metric    string      `json:"metric"`
+	Value     interface{} `json:"value"`
+	Threshold interface{} `json:"threshold"`
+}
+
+type checker struct {
+	kind  string
+	index string
+	//thresholds, 0 if not checked
+	status       string
+	unassigned   float64
+	pendingTasks float64
+	heapPercent  float64
+	diskPercent  float64
+	rejections   float64
+	minDocs      float64
+	maxDocs      float64
+	maxSize      float64
+	field        string        //date field of the freshness check
+	maxAge       time.Duration //age of the newest document
+	//thread pool rejections are counted since the start of each node, the
+	//previous counts are kept to find the new ones
+	lastRejections map[string]int64
+}
+
+func isCheckType(kind string) bool {
+	return kind == CHECK_CLUSTER_HEALTH || kind == CHECK_NODE_STATS || kind == CHECK_INDEX_STATS ||
+		kind == CHECK_FRESHNESS
+}
+
+// newChecker reads the thresholds of the check in the clauses of the query
+func newChecker(info *config.QueryInfo) (*checker, error) {
+	var err error
+
+	c := &checker{kind: info.Type, index: info.Index, lastRejections: make(map[string]int64)}
+	switch info.Type {
+	case CHECK_CLUSTER_HEALTH:
+		c.status = DEFAULT_HEALTH_STATUS
+		if status, ok := info.Clauses["status"]; ok {
+			c.status = strings.ToLower(fmt.Sprint(status))
+			if _, ok = g_healthLevels[c.status]; !ok || c.status == "green" {
+				return nil, errors.New("status must be yellow or red")
+			}
+		}
+		if c.unassigned, err = getThreshold(info.Clauses, "unassigned_shards", 0); err != nil {
+			return nil, err
+		}
+		if c.pendingTasks, err = getThreshold(info.Clauses, "pending_tasks", 0); err != nil {
+			return nil, err
+		}
+	case CHECK_NODE_STATS:
+		if c.heapPercent, err = getThreshold(info.Clauses, "heap_percent", DEFAULT_HEAP_PERCENT); err != nil {
+			return nil, err
+		}
+		if c.diskPercent, err = getThreshold(info.Clauses, "disk_percent", DEFAULT_DISK_PERCENT); err != nil {
+			return nil, err
+		}
+		if c.rejections, err = getThreshold(info.Clauses, "rejections", DEFAULT_REJECTIONS); err != nil {
+			return nil, err
+		}
+	case CHECK_INDEX_STATS:
+		if info.Index == "" {
+			return nil, errors.New("index cannot be empty")
+		}
+		if c.minDocs, err = getThreshold(info.Clauses, "min_docs", 0); err != nil {
+			return nil, err
+		}
+		if c.maxDocs, err = getThreshold(info.Clauses, "max_docs", 0); err != nil {
+			return nil, err
+		}
+		if size, ok := info.Clauses["max_size"]; ok {
+			if c.maxSize, err = parseSize(fmt.Sprint(size)); err != nil {
+				return nil, err
+			}
+		}
+		if c.minDocs == 0 && c.maxDocs == 0 && c.maxSize == 0 {
+			return nil, errors.New("index_stats needs min_docs, max_docs or max_size")
+		}
+	case CHECK_FRESHNESS:
+		if info.Index == "" {
+			return nil, errors.New("index cannot be empty")
+		}
+		c.field = DEFAULT_FRESHNESS_FIELD
+		if field, ok := info.Clauses["field"]; ok {
+			c.field = fmt.Sprint(field)
+		}
+		maxAge, ok := info.Clauses["max_age"]
+		if !ok {
+			return nil, errors.New("freshness needs a max_age")
+		}
+		if c.maxAge, err = time.ParseDuration(fmt.Sprint(maxAge)); err != nil || c.maxAge <= 0 {
+			return nil, fmt.Errorf("wrong max_age %v", maxAge)
+		}
+	default:
+		return nil, errors.New("unknown check " + info.Type)
+	}
+	return c, nil
+}
+
+func getThreshold(clauses map[string]interface{}, key string, defaultValue float64) (float64, error) {
+	value, ok := clauses[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	switch t := stringToNb(value).(type) {
+	case int:
+		return float64(t), nil
+	case float64:
+		return t, nil
+	}
+	return 0, fmt.Errorf("%s must be a number, got %v", key, value)
+}
+
+// parseSize reads sizes like 500mb or 2GB
+func parseSize(size string) (float64, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{{"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+
+	size = strings.ToLower(strings.TrimSpace(size))
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(size, unit.suffix)), 64)
+			if err != nil || value <= 0 {
+				return 0, fmt.Errorf("wrong size %s", size)
+			}
+			return value * unit.factor, nil
+		}
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("wrong size %s, use b, kb, mb, gb or tb", size)
+	}
+	return value, nil
+}
+
+// run calls the API of the check, and gives the problems found as a search result
+func (c *checker) run(ctx context.Context, cl *cluster) (*elastic.SearchResult, error) {
+	var problems []problem
+	var err error
+
+	switch c.kind {
+	case CHECK_CLUSTER_HEALTH:
+		problems, err = c.clusterHealth(ctx, cl)
+	case CHECK_NODE_STATS:
+		problems, err = c.nodeStats(ctx, cl)
+	case CHECK_INDEX_STATS:
+		problems, err = c.indexStats(ctx, cl)
+	case CHECK_FRESHNESS:
+		problems, err = c.freshness(ctx, cl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toSearchResult(problems)
+}
+
+func toSearchResult(problems []problem) (*elastic.SearchResult, error) {
+	hits := make([]*elastic.SearchHit, len(problems))
+	for i, p := range problems {
+		source, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		raw := json.RawMessage(source)
+		hits[i] = &elastic.SearchHit{Id: p.Name + ":" + p.Metric, Source: &raw}
+	}
+	return &elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: int64(len(hits)), Hits: hits}}, nil
+}
+
+func getJSON(ctx context.Context, cl *cluster, path string, ret interface{}) error {
+	res, err := cl.performRequest(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(res, ret); err != nil {
+		return &requestError{ERROR_TRANSPORT, err}
+	}
+	return nil
+}
+
+type clusterHealth struct {
+	ClusterName      string `json:"cluster_name"`
+	Status           string `json:"status"`
+	UnassignedShards int    `json:"unassigned_shards"`
+	PendingTasks     int    `json:"number_of_pending_tasks"`
+}
+
+func (c *checker) clusterHealth(ctx context.Context, cl *cluster) ([]problem, error) {
+	var health clusterHealth
+
+	path := "/_cluster/health"
+	if c.index != "" {
+		path += "/" + c.index
+	}
+	if err := getJSON(ctx, cl, path, &health); err != nil {
+		return nil, err
+	}
+	return c.healthProblems(&health), nil
+}
+
+func (c *checker) healthProblems(health *clusterHealth) []problem {
+	var ret []problem
+
+	if g_healthLevels[health.Status] >= g_healthLevels[c.status] {
+		ret = append(ret, problem{health.ClusterName, "status", health.Status, c.status})
+	}
+	if c.unassigned > 0 && float64(health.UnassignedShards) >= c.unassigned {
+		ret = append(ret, problem{health.ClusterName, "unassigned_shards", health.UnassignedShards, c.unassigned})
+	}
+	if c.pendingTasks > 0 && float64(health.PendingTasks) >= c.pendingTasks {
+		ret = append(ret, problem{health.ClusterName, "pending_tasks", health.PendingTasks, c.pendingTasks})
+	}
+	return ret
+}
+
+type nodesStats struct {
+	Nodes map[string]struct {
+		Name string `json:"name"`
+		Jvm  struct {
+			Mem struct {
+				HeapUsedPercent float64 `json:"heap_used_percent"`
+			} `json:"mem"`
+		} `json:"jvm"`
+		Fs struct {
+			Total struct {
+				Total     float64 `json:"total_in_bytes"`
+				Available float64 `json:"available_in_bytes"`
+			} `json:"total"`
+		} `json:"fs"`
+		ThreadPool map[string]struct {
+			Rejected int64 `json:"rejected"`
+		} `json:"thread_pool"`
+	} `json:"nodes"`
+}
+
+func (c *checker) nodeStats(ctx context.Context, cl *cluster) ([]problem, error) {
+	var stats nodesStats
+
+	if err := getJSON(ctx, cl, "/_nodes/stats/jvm,fs,thread_pool", &stats); err != nil {
+		return nil, err
+	}
+	return c.nodeProblems(&stats), nil
+}
+
+func (c *checker) nodeProblems(stats *nodesStats) []problem {
+	var ret []problem
+
+	ids := make([]string, 0, len(stats.Nodes))
+	for id := range stats.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node := stats.Nodes[id]
+		if c.heapPercent > 0 && node.Jvm.Mem.HeapUsedPercent >= c.heapPercent {
+			ret = append(ret, problem{node.Name, "heap_percent", node.Jvm.Mem.HeapUsedPercent, c.heapPercent})
+		}
+		if total := node.Fs.Total.Total; c.diskPercent > 0 && total > 0 {
+			used := float64(int((total-node.Fs.Total.Available)/total*1000)) / 10
+			if used >= c.diskPercent {
+				ret = append(ret, problem{node.Name, "disk_percent", used, c.diskPercent})
+			}
+		}
+		var rejected int64
+		for _, pool := range node.ThreadPool {
+			rejected += pool.Rejected
+		}
+		//the first time, or after a restart of the node, nothing to compare with
+		last, ok := c.lastRejections[id]
+		c.lastRejections[id] = rejected
+		if c.rejections > 0 && ok && rejected >= last && float64(rejected-last) >= c.rejections {
+			ret = append(ret, problem{node.Name, "rejections", rejected - last, c.rejections})
+		}
+	}
+	return ret
+}
+
+type indicesStats struct {
+	Indices map[string]struct {
+		Primaries struct {
+			Docs struct {
+				Count int64 `json:"count"`
+			} `json:"docs"`
+			Store struct {
+				Size int64 `json:"size_in_bytes"`
+			} `json:"store"`
+		} `json:"primaries"`
+	} `json:"indices"`
+}
+
+func (c *checker) indexStats(ctx context.Context, cl *cluster) ([]problem, error) {
+	var stats indicesStats
+
+	if err := getJSON(ctx, cl, "/"+c.index+"/_stats/docs,store", &stats); err != nil {
+		return nil, err
+	}
+	return c.indexProblems(&stats), nil
+}
+
+func (c *checker) indexProblems(stats *indicesStats) []problem {
+	var ret []problem
+
+	names := make([]string, 0, len(stats.Indices))
+	for name := range stats.Indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		primaries := stats.Indices[name].Primaries
+		count := primaries.Docs.Count
+		if c.minDocs > 0 && float64(count) < c.minDocs {
+			ret = append(ret, problem{name, "min_docs", count, c.minDocs})
+		}
+		if c.maxDocs > 0 && float64(count) > c.maxDocs {
+			ret = append(ret, problem{name, "max_docs", count, c.maxDocs})
+		}
+		if c.maxSize > 0 && float64(primaries.Store.Size) > c.maxSize {
+			ret = append(ret, problem{name, "max_size", primaries.Store.Size, c.maxSize})
+		}
+	}
+	return ret
+}
+
+type freshnessResult struct {
+	Hits struct {
+		Total int64 `json:"total"`
+	} `json:"hits"`
+	Aggregations struct {
+		Newest struct {
+			Value *float64 `json:"value"` //milliseconds since epoch, null without documents
+		} `json:"newest"`
+	} `json:"aggregations"`
+}
+
+// freshness gets the date of the newest document with a max aggregation, so that
+// elasticsearch parses the dates whatever their format
+func (c *checker) freshness(ctx context.Context, cl *cluster) ([]problem, error) {
+	var res freshnessResult
+
+	body := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"newest": map[string]interface{}{"max": map[string]string{"field": c.field}},
+		},
+	}
+	resp, err := cl.performRequest(ctx, "POST", "/"+c.index+"/_search", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, &requestError{ERROR_TRANSPORT, err}
+	}
+	return c.freshnessProblems(&res, time.Now()), nil
+}
+
+func (c *checker) freshnessProblems(res *freshnessResult, now time.Time) []problem {
+	newest := res.Aggregations.Newest.Value
+	if newest == nil {
+		return []problem{{c.index, "age", "no document", c.maxAge.String()}}
+	}
+	date := time.Unix(0, int64(*newest)*int64(time.Millisecond))
+	age := now.Sub(date)
+	if age <= c.maxAge {
+		return nil
+	}
+	return []problem{{c.index, "age", age.Truncate(time.Second).String(), c.maxAge.String()}}
+}
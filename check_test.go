@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/amundi/escheck/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_NewChecker(t *testing.T) {
+	c, err := newChecker(&config.QueryInfo{Type: CHECK_CLUSTER_HEALTH})
+	assert.Nil(t, err)
+	assert.Equal(t, "yellow", c.status)
+
+	_, err = newChecker(&config.QueryInfo{Type: CHECK_CLUSTER_HEALTH, Clauses: map[string]interface{}{"status": "green"}})
+	assert.NotNil(t, err)
+	_, err = newChecker(&config.QueryInfo{Type: CHECK_NODE_STATS, Clauses: map[string]interface{}{"heap_percent": "lots"}})
+	assert.NotNil(t, err)
+
+	c, err = newChecker(&config.QueryInfo{Type: CHECK_NODE_STATS, Clauses: map[string]interface{}{"heap_percent": "90", "disk_percent": 80.5}})
+	assert.Nil(t, err)
+	assert.Equal(t, 90.0, c.heapPercent)
+	assert.Equal(t, 80.5, c.diskPercent)
+	assert.Equal(t, float64(DEFAULT_REJECTIONS), c.rejections)
+
+	_, err = newChecker(&config.QueryInfo{Type: CHECK_INDEX_STATS, Index: "logs-*"})
+	assert.NotNil(t, err)
+	_, err = newChecker(&config.QueryInfo{Type: CHECK_INDEX_STATS, Clauses: map[string]interface{}{"max_docs": 10}})
+	assert.NotNil(t, err)
+	c, err = newChecker(&config.QueryInfo{Type: CHECK_INDEX_STATS, Index: "logs-*", Clauses: map[string]interface{}{"max_size": "1.5gb"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5*(1<<30), c.maxSize)
+}
+
+func Test_ParseSize(t *testing.T) {
+	size, err := parseSize("500mb")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(500<<20), size)
+	size, err = parseSize("2 GB")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2<<30), size)
+	size, err = parseSize("1024")
+	assert.Nil(t, err)
+	assert.Equal(t, 1024.0, size)
+	_, err = parseSize("big")
+	assert.NotNil(t, err)
+	_, err = parseSize("-1gb")
+	assert.NotNil(t, err)
+}
+
+func Test_HealthProblems(t *testing.T) {
+	var health clusterHealth
+
+	c, _ := newChecker(&config.QueryInfo{Type: CHECK_CLUSTER_HEALTH, Clauses: map[string]interface{}{"pending_tasks": 10}})
+	json.Unmarshal([]byte(`{"cluster_name":"prod","status":"green","unassigned_shards":0,"number_of_pending_tasks":2}`), &health)
+	assert.Nil(t, c.healthProblems(&health))
+
+	json.Unmarshal([]byte(`{"cluster_name":"prod","status":"yellow","unassigned_shards":3,"number_of_pending_tasks":12}`), &health)
+	assert.Equal(t, []problem{
+		{"prod", "status", "yellow", "yellow"},
+		{"prod", "pending_tasks", 12, 10.0},
+	}, c.healthProblems(&health))
+
+	//only red
+	c, _ = newChecker(&config.QueryInfo{Type: CHECK_CLUSTER_HEALTH, Clauses: map[string]interface{}{"status": "red", "unassigned_shards": 1}})
+	assert.Equal(t, []problem{{"prod", "unassigned_shards", 3, 1.0}}, c.healthProblems(&health))
+}
+
+func Test_NodeProblems(t *testing.T) {
+	var stats nodesStats
+
+	c, _ := newChecker(&config.QueryInfo{Type: CHECK_NODE_STATS})
+	json.Unmarshal([]byte(`{"nodes":{
+		"a":{"name":"node1","jvm":{"mem":{"heap_used_percent":91}},
+			"fs":{"total":{"total_in_bytes":1000,"available_in_bytes":100}},
+			"thread_pool":{"search":{"rejected":5},"bulk":{"rejected":2}}},
+		"b":{"name":"node2","jvm":{"mem":{"heap_used_percent":40}},
+			"fs":{"total":{"total_in_bytes":1000,"available_in_bytes":500}},
+			"thread_pool":{"search":{"rejected":0}}}}}`), &stats)
+	//the rejections are only counted from the first run
+	assert.Equal(t, []problem{
+		{"node1", "heap_percent", 91.0, 85.0},
+		{"node1", "disk_percent", 90.0, 85.0},
+	}, c.nodeProblems(&stats))
+
+	json.Unmarshal([]byte(`{"nodes":{
+		"a":{"name":"node1","jvm":{"mem":{"heap_used_percent":50}},
+			"fs":{"total":{"total_in_bytes":1000,"available_in_bytes":900}},
+			"thread_pool":{"search":{"rejected":5},"bulk":{"rejected":2}}},
+		"b":{"name":"node2","jvm":{"mem":{"heap_used_percent":40}},
+			"fs":{"total":{"total_in_bytes":1000,"available_in_bytes":500}},
+			"thread_pool":{"search":{"rejected":4}}}}}`), &stats)
+	assert.Equal(t, []problem{{"node2", "rejections", int64(4), 1.0}}, c.nodeProblems(&stats))
+}
+
+func Test_IndexProblems(t *testing.T) {
+	var stats indicesStats
+
+	c, _ := newChecker(&config.QueryInfo{Type: CHECK_INDEX_STATS, Index: "logs-*",
+		Clauses: map[string]interface{}{"min_docs": 10, "max_size": "1kb"}})
+	json.Unmarshal([]byte(`{"indices":{
+		"logs-1":{"primaries":{"docs":{"count":5},"store":{"size_in_bytes":100}}},
+		"logs-2":{"primaries":{"docs":{"count":500},"store":{"size_in_bytes":2048}}}}}`), &stats)
+	assert.Equal(t, []problem{
+		{"logs-1", "min_docs", int64(5), 10.0},
+		{"logs-2", "max_size", int64(2048), 1024.0},
+	}, c.indexProblems(&stats))
+}
+
+func Test_ToSearchResult(t *testing.T) {
+	res, err := toSearchResult([]problem{{"node1", "heap_percent", 91.0, 85.0}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Hits.TotalHits)
+	assert.Equal(t, "node1:heap_percent", res.Hits.Hits[0].Id)
+	columns, rows := getTable(res.Hits.Hits, g_checkColumns)
+	assert.Equal(t, g_checkColumns, columns)
+	assert.Equal(t, [][]string{{"node1", "heap_percent", "91", "85"}}, rows)
+
+	res, err = toSearchResult(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), res.Hits.TotalHits)
+}
+
+func Test_FreshnessProblems(t *testing.T) {
+	var res freshnessResult
+
+	_, err := newChecker(&config.QueryInfo{Type: CHECK_FRESHNESS, Index: "logstash-*"})
+	assert.NotNil(t, err)
+	_, err = newChecker(&config.QueryInfo{Type: CHECK_FRESHNESS, Clauses: map[string]interface{}{"max_age": "10m"}})
+	assert.NotNil(t, err)
+	_, err = newChecker(&config.QueryInfo{Type: CHECK_FRESHNESS, Index: "logstash-*", Clauses: map[string]interface{}{"max_age": "soon"}})
+	assert.NotNil(t, err)
+	c, err := newChecker(&config.QueryInfo{Type: CHECK_FRESHNESS, Index: "logstash-*", Clauses: map[string]interface{}{"max_age": "10m"}})
+	assert.Nil(t, err)
+	assert.Equal(t, DEFAULT_FRESHNESS_FIELD, c.field)
+
+	//newest document on 2016-01-01 00:00:00 UTC
+	json.Unmarshal([]byte(`{"hits":{"total":42},"aggregations":{"newest":{"value":1451606400000,"value_as_string":"2016-01-01T00:00:00.000Z"}}}`), &res)
+	newest := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, c.freshnessProblems(&res, newest.Add(5*time.Minute)))
+	assert.Equal(t, []problem{{"logstash-*", "age", "12m30s", "10m0s"}}, c.freshnessProblems(&res, newest.Add(12*time.Minute+30*time.Second)))
+
+	//no document at all
+	json.Unmarshal([]byte(`{"hits":{"total":0},"aggregations":{"newest":{"value":null}}}`), &res)
+	assert.Equal(t, []problem{{"logstash-*", "age", "no document", "10m0s"}}, c.freshnessProblems(&res, newest))
+}
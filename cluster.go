@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"gopkg.in/olivere/elastic.v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+** The requests to the cluster go through a limited number of slots, so that
+** eschecker doesn't overload it. The searches due at about the same time are
+** grouped in a multi-search request, which takes only one slot.
+ */
+
+const (
+	DEFAULT_CONCURRENCY    = 4
+	DEFAULT_MSEARCH_WINDOW = 200 * time.Millisecond
+	DEFAULT_MSEARCH_MAX    = 50
+)
+
+type cluster struct {
+	url        string
+	login      string
+	password   string
+	httpClient *http.Client
+	slots      chan struct{}
+	window     time.Duration //how long a search waits for others to be grouped with, 0 to never group
+	maxBatch   int
+	pending    chan *searchRequest
+	//sends a multi-search, replaced in the tests
+	doMsearch func([]*searchRequest) ([]searchResponse, error)
+}
+
+type searchRequest struct {
+	index   string
+	body    map[string]interface{}
+	timeout time.Duration
+	ctx     context.Context //done once the caller has given up
+	sent    chan struct{}   //closed when the multi-search is sent
+	result  chan searchResponse
+}
+
+type searchResponse struct {
+	result *elastic.SearchResult
+	err    error
+}
+
+// newCluster uses httpClient for the requests, the default client if nil
+func newCluster(httpClient *http.Client) (*cluster, error) {
+	info := config.G_Config.Config
+	c := &cluster{
+		url:        strings.TrimSuffix(info.Cluster_addr, "/"),
+		httpClient: httpClient,
+		window:     DEFAULT_MSEARCH_WINDOW,
+		maxBatch:   DEFAULT_MSEARCH_MAX,
+		pending:    make(chan *searchRequest),
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	if isAuthentication() {
+		c.login = getAuthLogin()
+		c.password = getAuthPassword()
+	}
+	c.doMsearch = c.msearch
+	concurrency := DEFAULT_CONCURRENCY
+	if info.Cluster_concurrency > 0 {
+		concurrency = info.Cluster_concurrency
+	}
+	c.slots = make(chan struct{}, concurrency)
+	if info.Msearch_max > 0 {
+		c.maxBatch = info.Msearch_max
+	}
+	if info.Msearch_window != "" {
+		window, err := time.ParseDuration(info.Msearch_window)
+		if err != nil || window < 0 {
+			return c, errors.New("wrong msearch_window " + info.Msearch_window + ", using the default one")
+		}
+		c.window = window
+	}
+	return c, nil
+}
+
+func (c *cluster) acquire() {
+	c.slots <- struct{}{}
+}
+
+func (c *cluster) release() {
+	<-c.slots
+}
+
+func (c *cluster) isBatching() bool {
+	return c.window > 0 && c.maxBatch > 1
+}
+
+// search waits for the search to be sent in a multi-search, then for its result.
+// The timeout starts when the search is queued, so that a search waiting for a
+// free slot doesn't wait longer than a single search.
+func (c *cluster) search(index string, body map[string]interface{}, timeout time.Duration) (*elastic.SearchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req := &searchRequest{
+		index:   index,
+		body:    body,
+		timeout: timeout,
+		ctx:     ctx,
+		sent:    make(chan struct{}),
+		result:  make(chan searchResponse, 1),
+	}
+	select {
+	case c.pending <- req:
+	case <-ctx.Done():
+		return nil, newTimeoutError("request in index %s has timeout'ed before being sent", index)
+	}
+	select {
+	case <-req.sent:
+	case <-ctx.Done():
+		return nil, newTimeoutError("request in index %s has timeout'ed before being sent", index)
+	}
+	//the result is buffered, a late one is dropped
+	select {
+	case res := <-req.result:
+		return res.result, res.err
+	case <-ctx.Done():
+		return nil, newTimeoutError("request in index %s has timeout'ed", index)
+	}
+}
+
+// run groups the searches arriving in the same window, or waiting for a free
+// slot, and sends them
+func (c *cluster) run() {
+	for {
+		batch := []*searchRequest{<-c.pending}
+		c.acquire()
+		timer := time.After(c.window)
+	collect:
+		for len(batch) < c.maxBatch {
+			select {
+			case req := <-c.pending:
+				batch = append(batch, req)
+			case <-timer:
+				break collect
+			}
+		}
+		go func(batch []*searchRequest) {
+			defer c.release()
+			batch = getLiveRequests(batch)
+			if len(batch) == 0 {
+				return
+			}
+			responses, err := c.doMsearch(batch)
+			for i, req := range batch {
+				if err != nil {
+					req.result <- searchResponse{nil, err}
+				} else {
+					req.result <- responses[i]
+				}
+			}
+		}(batch)
+	}
+}
+
+// getLiveRequests closes sent for the searches of the batch, and gives the ones
+// whose caller is still waiting. The others timed out while waiting for a slot.
+func getLiveRequests(batch []*searchRequest) []*searchRequest {
+	ret := make([]*searchRequest, 0, len(batch))
+	for _, req := range batch {
+		close(req.sent)
+		if req.ctx.Err() == nil {
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
+
+func (c *cluster) msearch(batch []*searchRequest) ([]searchResponse, error) {
+	var res struct {
+		Responses []json.RawMessage `json:"responses"`
+	}
+
+	body, err := getMsearchBody(batch)
+	if err != nil {
+		return nil, &requestError{ERROR_QUERY, err}
+	}
+	//the multi-search is given up when the slowest of its searches would be
+	ctx, cancel := context.WithTimeout(context.Background(), getMaxTimeout(batch))
+	defer cancel()
+	resp, err := c.performRequest(ctx, "POST", "/_msearch", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, &requestError{ERROR_TRANSPORT, err}
+	}
+	return getMsearchResponses(res.Responses, len(batch))
+}
+
+func getMaxTimeout(batch []*searchRequest) time.Duration {
+	var ret time.Duration
+
+	for _, req := range batch {
+		if req.timeout > ret {
+			ret = req.timeout
+		}
+	}
+	return ret
+}
+
+// getMsearchBody writes a header and a body line per search
+func getMsearchBody(batch []*searchRequest) (string, error) {
+	var buf bytes.Buffer
+
+	for _, req := range batch {
+		header, err := json.Marshal(map[string]string{"index": req.index})
+		if err != nil {
+			return "", err
+		}
+		body, err := json.Marshal(req.body)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(header)
+		buf.WriteByte('\n')
+		buf.Write(body)
+		buf.WriteByte('\n')
+	}
+	return buf.String(), nil
+}
+
+// getMsearchResponses reads the responses, in the order of the searches. A
+// search can fail while the others succeed.
+func getMsearchResponses(responses []json.RawMessage, size int) ([]searchResponse, error) {
+	if len(responses) != size {
+		return nil, &requestError{ERROR_TRANSPORT, fmt.Errorf("multi-search sent back %d responses for %d searches", len(responses), size)}
+	}
+	ret := make([]searchResponse, size)
+	for i, raw := range responses {
+		var failure struct {
+			Error interface{} `json:"error"`
+		}
+		if err := json.Unmarshal(raw, &failure); err != nil {
+			ret[i].err = &requestError{ERROR_TRANSPORT, err}
+			continue
+		}
+		if failure.Error != nil {
+			ret[i].err = &requestError{ERROR_QUERY, fmt.Errorf("search failed : %v", failure.Error)}
+			continue
+		}
+		result := new(elastic.SearchResult)
+		if err := json.Unmarshal(raw, result); err != nil {
+			ret[i].err = &requestError{ERROR_TRANSPORT, err}
+			continue
+		}
+		ret[i].result = result
+	}
+	return ret, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/amundi/escheck/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_NewCluster(t *testing.T) {
+	config.G_Config.Config = &config.Config{}
+	c, err := newCluster(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, DEFAULT_CONCURRENCY, cap(c.slots))
+	assert.Equal(t, DEFAULT_MSEARCH_WINDOW, c.window)
+	assert.True(t, c.isBatching())
+
+	config.G_Config.Config = &config.Config{Cluster_concurrency: 2, Msearch_window: "0s"}
+	c, err = newCluster(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cap(c.slots))
+	assert.False(t, c.isBatching())
+
+	config.G_Config.Config = &config.Config{Msearch_window: "pouet"}
+	c, err = newCluster(nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, DEFAULT_MSEARCH_WINDOW, c.window)
+}
+
+func Test_MsearchBody(t *testing.T) {
+	batch := []*searchRequest{
+		{index: "logs-*", body: map[string]interface{}{"size": 0}},
+		{index: "app", body: map[string]interface{}{"size": 10}},
+	}
+	body, err := getMsearchBody(batch)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"index\":\"logs-*\"}\n{\"size\":0}\n{\"index\":\"app\"}\n{\"size\":10}\n", body)
+}
+
+func Test_MsearchResponses(t *testing.T) {
+	var res struct {
+		Responses []json.RawMessage `json:"responses"`
+	}
+
+	json.Unmarshal([]byte(`{"responses":[
+		{"took":3,"hits":{"total":42,"hits":[]}},
+		{"error":"IndexMissingException[[nope] missing]"}]}`), &res)
+	responses, err := getMsearchResponses(res.Responses, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, responses[0].err)
+	assert.Equal(t, int64(42), responses[0].result.Hits.TotalHits)
+	assert.NotNil(t, responses[1].err)
+	assert.Nil(t, responses[1].result)
+
+	_, err = getMsearchResponses(res.Responses, 3)
+	assert.NotNil(t, err)
+}
+
+func Test_ClusterBatch(t *testing.T) {
+	var sizes []int
+	var lock sync.Mutex
+
+	config.G_Config.Config = &config.Config{Cluster_concurrency: 1, Msearch_window: "50ms"}
+	c, _ := newCluster(nil)
+	c.doMsearch = func(batch []*searchRequest) ([]searchResponse, error) {
+		lock.Lock()
+		sizes = append(sizes, len(batch))
+		lock.Unlock()
+		if batch[0].index == "down" {
+			return nil, errors.New("cluster down")
+		}
+		ret := make([]searchResponse, len(batch))
+		for i := range batch {
+			ret[i].result = &elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: int64(i)}}
+		}
+		return ret, nil
+	}
+	go c.run()
+
+	//searches due at the same time are grouped
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.search("logs", map[string]interface{}{}, time.Second)
+			assert.Nil(t, err)
+			assert.NotNil(t, res)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []int{3}, sizes)
+
+	_, err := c.search("down", map[string]interface{}{}, time.Second)
+	assert.NotNil(t, err)
+	assert.Equal(t, []int{3, 1}, sizes)
+
+	//the time waiting for a free slot counts in the timeout
+	c.acquire()
+	start := time.Now()
+	_, err = c.search("logs", map[string]interface{}{}, 100*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Equal(t, ERROR_TIMEOUT, getErrorKind(err))
+	assert.True(t, time.Since(start) < time.Second)
+	c.release()
+	//and the search given up is not sent
+	_, err = c.search("logs", map[string]interface{}{}, time.Second)
+	assert.Nil(t, err)
+	lock.Lock()
+	assert.Equal(t, []int{3, 1, 1}, sizes)
+	lock.Unlock()
+}
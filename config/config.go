@@ -2,21 +2,50 @@ package config
 
 // full config struct
 type Config struct {
-	Cluster_addr    string
-	Auth_login      string
-	Auth_password   string
-	Server_mode     bool
-	Server_path     string
-	Server_port     string
-	Server_login    string
-	Server_password string
-	Log             bool
-	Log_path        string
-	Log_name        string
-	Rotate_every    int
-	Number_of_files int
-	Workers         int
-	Max_retries     int
+	Cluster_addr  string
+	Cluster_proxy string //proxy for the cluster only, "none" to ignore the environment
+	//number of requests sent at the same time to the cluster. The searches
+	//due in the same msearch_window are grouped, msearch_max at most
+	Cluster_concurrency int
+	Msearch_window      string
+	Msearch_max         int
+	Auth_login          string
+	Auth_password       string
+	Server_mode         bool
+	Server_path         string
+	Server_port         string
+	Server_login        string
+	Server_password     string
+	Server_url          string //url of the server in the links of the notifications
+	Log                 bool
+	Log_path            string
+	Log_name            string
+	Rotate_every        int
+	Number_of_files     int
+	Workers             int
+	Max_retries         int
+	//failing queries wait retry_backoff, doubled after each failure. After
+	//max_retries failures they are suspended, and tried every suspend_schedule
+	Retry_backoff    string
+	Suspend_schedule string
+	//what to do when some shards fail: error, warn or ignore. The admin_actions
+	//are notified if partial_results_notify
+	Partial_results        string
+	Partial_results_notify bool
+	Proxy                  string //proxy of the integrations, like slack
+	Outbox                 Outbox
+	Admin_actions          Actions //where eschecker reports its own problems
+	Heartbeat              Heartbeat
+	//file of the queries created by the API, merged with the querylist
+	Rules_file string
+	//the receivers of the alerts, by severity and labels of the queries
+	Routing   []Route
+	Receivers map[string]Receiver
+	//policies notifying more receivers when the alerts are not acknowledged
+	Escalations map[string][]Tier
+	//the alerts of each query, kept across the restarts if history_file is set
+	History_file string
+	History_size int
 	mailinfo
 	slackinfo
 	QueryList map[string]Query `yaml:"querylist"`
@@ -28,8 +57,15 @@ type Query struct {
 	Alert_onlyonce bool
 	TimeOut        string
 	Alert_endmsg   bool
-	Query          QueryInfo
-	Actions        Actions
+	Digest         string //send a summary every period instead of each alert
+	Max_retries    int    //overrides the global max_retries if not 0
+	//overrides the global partial_results if not empty
+	Partial_results string
+	Severity        string //info, warning or critical. warning by default
+	Labels          map[string]string
+	Escalation      string //policy of the escalations section
+	Query           QueryInfo
+	Actions         Actions
 }
 
 //information about query structs
@@ -39,38 +75,109 @@ type QueryInfo struct {
 	SortOrder string
 	NbDocs    int
 	Limit     int
-	Type      string
-	Clauses   map[string]interface{}
+	//fields of the documents to fetch and display in the notifications
+	Display_fields []string
+	Type           string
+	Clauses        map[string]interface{}
 }
 
 type Actions struct {
 	List  []string //list of present actions, for example ["email", "slack"]
 	Email Email
 	Slack Slack
+	Index Index
 }
 
 type Email struct {
-	To    []string
-	Title string
-	Text  string
+	To       []string
+	Cc       []string
+	Bcc      []string
+	Reply_to string
+	Title    string
+	Text     string
+	//attach the documents found to the mail
+	Attach        string   //csv or json
+	Attach_fields []string //the columns of the csv
+	Attach_max    int      //number of documents to attach, if more than nbdocs
 }
 
 type Slack struct {
 	Channel string
 	Text    string
 	User    string
+	Webhook string //overrides the incoming webhook of slackinfo
+	//post the end of alert and the repeated alerts as replies to the first alert
+	Thread          bool
+	Update_resolved bool //modify the first alert to show it's resolved
+}
+
+// the first route matching the severity and the labels of a query gives the
+// receivers it notifies. A route without severity matches all of them.
+type Route struct {
+	Severity  string
+	Labels    map[string]string
+	Receivers []string
+}
+
+// actions notified by the routes, like the ones of a query
+type Receiver struct {
+	Digest  string
+	Actions `yaml:",inline"`
+}
+
+// a tier of an escalation policy: its receivers are notified when an alert is
+// still active and not acknowledged after the delay, since its start
+type Tier struct {
+	After     string
+	Receivers []string
+}
+
+// the alerts are written in this index of the cluster. YYYY, MM and DD are
+// replaced by the date, like escheck-alerts-YYYY.MM
+type Index struct {
+	Name string
+	Type string //type of the documents, alert by default. _doc for elasticsearch 7+
+}
+
+// notifications that failed are sent again, waiting from retry_min to
+// retry_max between the attempts, and given up after max_age. If path is
+// set, they are saved in this directory to survive a restart.
+type Outbox struct {
+	Path      string
+	Max_age   string
+	Retry_min string
+	Retry_max string
+}
+
+// dead man's switch: the url is called and the file is written every period,
+// as long as no query is late by more than grace for its next cycle
+type Heartbeat struct {
+	Url   string
+	File  string
+	Every string
+	Grace string
 }
 
 // information about mail server etc.
 type mailinfo struct {
-	Server   string
-	Port     int
-	Username string
-	Password string
+	Server      string
+	Port        int
+	Username    string
+	Password    string
+	Security    string //none, tls or starttls
+	Auth        string //plain, login or cram-md5
+	Skip_verify bool   //don't check the certificate of the server
 }
 
 type slackinfo struct {
-	Token string
+	Token   string
+	Webhook string //if set, messages are sent to this incoming webhook instead of the API
+	Proxy   string //overrides the global proxy
+}
+
+// the proxy of slackinfo is shadowed by the global one
+func (c *Config) GetSlackProxy() string {
+	return c.slackinfo.Proxy
 }
 
 type ManualConfig struct {
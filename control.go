@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"sync"
+	"time"
+)
+
+/*
+** Each running query has a control, used by the management API: the query loop
+** waits on it instead of only sleeping, so that it can be run at once, paused
+** and resumed. A muted query still runs, but doesn't do its actions.
+ */
+
+// queryConfig is the config really used by a query, with the defaults
+type queryConfig struct {
+	Schedule        string            `json:"schedule"`
+	Timeout         string            `json:"timeout"`
+	Alert_onlyonce  bool              `json:"alert_onlyonce"`
+	Alert_endmsg    bool              `json:"alert_endmsg"`
+	Digest          string            `json:"digest,omitempty"`
+	Max_retries     int               `json:"max_retries"`
+	Partial_results string            `json:"partial_results"`
+	Severity        string            `json:"severity"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Escalation      string            `json:"escalation,omitempty"`
+	Query           config.QueryInfo  `json:"query"`
+	Actions         []string          `json:"actions"`
+}
+
+type queryControl struct {
+	name    string
+	config  *queryConfig //nil until the query is started
+	timeOut time.Duration
+	wake    chan struct{} //the query must check its state
+	done    chan struct{} //closed when the loop of the query has ended
+	runNow  bool
+	stopped bool //the query is deleted or replaced
+	paused  bool
+	muted   bool
+	sync.Mutex
+}
+
+var g_controls = struct {
+	list map[string]*queryControl
+	sync.RWMutex
+}{list: make(map[string]*queryControl)}
+
+func newQueryControl(name string, info queryConfig, timeOut time.Duration) *queryControl {
+	return &queryControl{
+		name:    name,
+		config:  &info,
+		timeOut: timeOut,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// newPendingControl gives the control of a query not started yet, registered
+// at once so that the API can stop the query while it starts
+func newPendingControl(name string) *queryControl {
+	c := newQueryControl(name, queryConfig{}, 0)
+	c.config = nil
+	return c
+}
+
+func getQueryConfig(info *config.Query, schedule *scheduler, send *sender, partialPolicy string) queryConfig {
+	query := info.Query
+	if query.Clauses != nil {
+		query.Clauses = toJSONValue(query.Clauses).(map[string]interface{})
+	}
+	severity, _ := getSeverity(info.Severity)
+	return queryConfig{
+		Schedule:        schedule.waitSchedule.String(),
+		Timeout:         send.timeOut.String(),
+		Alert_onlyonce:  schedule.isAlertOnlyOnce,
+		Alert_endmsg:    schedule.isAlertEndMsg,
+		Digest:          info.Digest,
+		Max_retries:     schedule.maxRetries,
+		Partial_results: partialPolicy,
+		Severity:        severity,
+		Labels:          info.Labels,
+		Escalation:      info.Escalation,
+		Query:           query,
+		Actions:         info.Actions.List,
+	}
+}
+
+// toJSONValue converts the maps read in the yaml, which json can't encode
+func toJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			ret[fmt.Sprint(key)] = toJSONValue(elem)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			ret[key] = toJSONValue(elem)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, elem := range v {
+			ret[i] = toJSONValue(elem)
+		}
+		return ret
+	}
+	return value
+}
+
+func registerControl(c *queryControl) {
+	g_controls.Lock()
+	defer g_controls.Unlock()
+	g_controls.list[c.name] = c
+}
+
+// unregisterControl removes the control, if it is still the one of its query
+func unregisterControl(c *queryControl) {
+	g_controls.Lock()
+	defer g_controls.Unlock()
+	if g_controls.list[c.name] == c {
+		delete(g_controls.list, c.name)
+	}
+}
+
+func getControl(name string) *queryControl {
+	g_controls.RLock()
+	defer g_controls.RUnlock()
+	return g_controls.list[name]
+}
+
+// isRegistered tells if the control is still the one of its query
+func (c *queryControl) isRegistered() bool {
+	return getControl(c.name) == c
+}
+
+// sleep waits for d, or less if the query is run at once. A paused query
+// waits until it is resumed or run.
+func (c *queryControl) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	elapsed, forgotten := false, false
+	//a paused query isn't watched by the heartbeat until it runs again
+	defer func() {
+		if forgotten {
+			heartbeatBeat(c.name, c.getTimeOut())
+		}
+	}()
+	for {
+		if c.isStopped() || (elapsed && !c.isPaused()) {
+			return
+		}
+		select {
+		case <-timer.C:
+			elapsed = true
+			if c.isPaused() {
+				heartbeatForget(c.name)
+				forgotten = true
+			}
+		case <-c.wake:
+			if c.takeRunNow() {
+				return
+			}
+		}
+	}
+}
+
+// wakeUp tells the query to check its state. A wake up already waiting is enough.
+func (c *queryControl) wakeUp() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run makes the query run at once, even if it is paused
+func (c *queryControl) run() {
+	c.Lock()
+	c.runNow = true
+	c.Unlock()
+	c.wakeUp()
+}
+
+func (c *queryControl) takeRunNow() bool {
+	c.Lock()
+	defer c.Unlock()
+	ret := c.runNow
+	c.runNow = false
+	return ret
+}
+
+// pause stops the query after its current run
+func (c *queryControl) pause() {
+	c.Lock()
+	defer c.Unlock()
+	c.paused = true
+}
+
+func (c *queryControl) resume() {
+	c.Lock()
+	c.paused = false
+	c.Unlock()
+	c.wakeUp()
+}
+
+// stop ends the loop of the query, after its current run
+func (c *queryControl) stop() {
+	c.Lock()
+	c.stopped = true
+	c.Unlock()
+	c.wakeUp()
+}
+
+// start gives the config of the query once its loop starts
+func (c *queryControl) start(info queryConfig, timeOut time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.config = &info
+	c.timeOut = timeOut
+}
+
+// getConfig gives the config of the query, nil if it is not started yet
+func (c *queryControl) getConfig() *queryConfig {
+	c.Lock()
+	defer c.Unlock()
+	if c.config == nil {
+		return nil
+	}
+	info := *c.config
+	return &info
+}
+
+func (c *queryControl) getTimeOut() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return c.timeOut
+}
+
+// wait waits for the end of the loop of the query
+func (c *queryControl) wait() {
+	<-c.done
+}
+
+func (c *queryControl) isStopped() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.stopped
+}
+
+func (c *queryControl) setMuted(muted bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.muted = muted
+}
+
+func (c *queryControl) isPaused() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.paused
+}
+
+func (c *queryControl) isMuted() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.muted
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// sleepAsync sleeps in a goroutine, and tells when the sleep is over
+func sleepAsync(c *queryControl, d time.Duration) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		c.sleep(d)
+		close(done)
+	}()
+	return done
+}
+
+func isDone(done chan struct{}, wait time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func Test_ControlSleep(t *testing.T) {
+	c := newQueryControl("q1", queryConfig{}, time.Second)
+
+	//the sleep ends normally
+	assert.True(t, isDone(sleepAsync(c, 10*time.Millisecond), time.Second))
+
+	//or at once when the query is run
+	done := sleepAsync(c, time.Hour)
+	assert.False(t, isDone(done, 20*time.Millisecond))
+	c.run()
+	assert.True(t, isDone(done, time.Second))
+
+	//a paused query waits to be resumed, and isn't watched by the heartbeat
+	heartbeatBeat("q1", time.Millisecond)
+	c.pause()
+	done = sleepAsync(c, 10*time.Millisecond)
+	assert.False(t, isDone(done, 50*time.Millisecond))
+	assert.Equal(t, 0, len(getStuckQueries(time.Now().Add(time.Hour))))
+	c.resume()
+	assert.True(t, isDone(done, time.Second))
+	assert.False(t, c.isPaused())
+	assert.Equal(t, []string{"q1"}, getStuckQueries(time.Now().Add(time.Hour)))
+	heartbeatForget("q1")
+
+	//a paused query can be run once
+	c.pause()
+	done = sleepAsync(c, 10*time.Millisecond)
+	assert.False(t, isDone(done, 50*time.Millisecond))
+	c.run()
+	assert.True(t, isDone(done, time.Second))
+	assert.True(t, c.isPaused())
+	heartbeatForget("q1")
+
+	c.setMuted(true)
+	assert.True(t, c.isMuted())
+	c.setMuted(false)
+	assert.False(t, c.isMuted())
+}
+
+func Test_ToJSONValue(t *testing.T) {
+	clauses := map[string]interface{}{
+		"must": []interface{}{
+			map[interface{}]interface{}{"term": []interface{}{"status", "Error"}},
+		},
+	}
+	value := toJSONValue(clauses).(map[string]interface{})
+	_, ok := value["must"].([]interface{})[0].(map[string]interface{})
+	assert.True(t, ok)
+	content, err := json.Marshal(value)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"must":[{"term":["status","Error"]}]}`, string(content))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amundi/escheck/worker"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+** HTML page of the stats server, readable at a glance. Everything is in the
+** page, without any external asset, so it works on a closed network. The json
+** of the stats is still given at server_path/json.
+ */
+
+const (
+	//seconds between two refreshes of the page, unless the refresh parameter is given
+	DASHBOARD_REFRESH = 30
+	SPARKLINE_WIDTH   = 100
+	SPARKLINE_HEIGHT  = 20
+	STATE_DOWN        = "down"
+	STATE_SUSPENDED   = "suspended"
+	STATE_ALERTING    = "alerting"
+	STATE_DEGRADED    = "degraded"
+	STATE_OK          = "ok"
+)
+
+//request to render the dashboard
+type dashboardRequest struct {
+	w http.ResponseWriter
+	r *http.Request
+	c chan struct{}
+}
+
+type dashboardRow struct {
+	Name string
+	queryStats
+	State     string
+	Sparkline string //points of the svg polyline of the hits
+	MaxHits   int64
+}
+
+type dashboardPage struct {
+	Rows    []dashboardRow
+	Total   int
+	Name    string
+	State   string
+	States  []string
+	Refresh int
+	//the query whose alerts are shown, and its events
+	History string
+	Events  []alertEvent
+}
+
+var g_dashboardTemplate = template.Must(template.New("dashboard").Parse(DASHBOARD_TEMPLATE))
+
+// collector for the dashboard, like collectorDisplay
+func collectorDashboard(w http.ResponseWriter, r *http.Request) {
+	req := dashboardRequest{w, r, make(chan struct{}, 1)}
+	worker.G_WorkQueue <- req
+	<-req.c
+}
+
+func (d dashboardRequest) DoRequest() {
+	defer func() { d.c <- struct{}{} }()
+	page := getDashboardPage(d.r)
+	d.w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := g_dashboardTemplate.Execute(d.w, page); err != nil {
+		http.Error(d.w, "Error while rendering the dashboard", http.StatusInternalServerError)
+	}
+}
+
+// getDashboardPage gives the queries matching the name and state parameters,
+// sorted by name
+func getDashboardPage(r *http.Request) dashboardPage {
+	page := dashboardPage{
+		Name:    r.FormValue("name"),
+		State:   r.FormValue("state"),
+		States:  []string{STATE_DOWN, STATE_SUSPENDED, STATE_ALERTING, STATE_DEGRADED, STATE_OK},
+		Refresh: DASHBOARD_REFRESH,
+		History: r.FormValue("history"),
+	}
+	if refresh, err := strconv.Atoi(r.FormValue("refresh")); err == nil && refresh >= 0 {
+		page.Refresh = refresh
+	}
+
+	stats.RLock()
+	page.Total = len(stats.statsMap)
+	for name, s := range stats.statsMap {
+		row := dashboardRow{Name: name, queryStats: s, State: getState(s)}
+		if page.Name != "" && !strings.Contains(strings.ToLower(name), strings.ToLower(page.Name)) {
+			continue
+		}
+		if page.State != "" && page.State != row.State {
+			continue
+		}
+		row.Sparkline, row.MaxHits = getSparkline(s.Hits)
+		page.Rows = append(page.Rows, row)
+	}
+	stats.RUnlock()
+	sort.Slice(page.Rows, func(i, j int) bool { return page.Rows[i].Name < page.Rows[j].Name })
+	if page.History != "" {
+		page.Events = getHistory(page.History)
+	}
+	return page
+}
+
+// getState gives the most important state of a query
+func getState(s queryStats) string {
+	switch {
+	case s.Suspended:
+		return STATE_SUSPENDED
+	case !s.IsUp:
+		return STATE_DOWN
+	case s.AlertStatus:
+		return STATE_ALERTING
+	case s.Degraded:
+		return STATE_DEGRADED
+	}
+	return STATE_OK
+}
+
+// getSparkline gives the points of a line showing the hits, and the max
+func getSparkline(hits []int64) (string, int64) {
+	var max int64
+	var points []string
+
+	if len(hits) == 0 {
+		return "", 0
+	}
+	for _, h := range hits {
+		if h > max {
+			max = h
+		}
+	}
+	step := 0
+	if len(hits) > 1 {
+		step = SPARKLINE_WIDTH / (len(hits) - 1)
+	}
+	for i, h := range hits {
+		y := SPARKLINE_HEIGHT
+		if max > 0 {
+			y = SPARKLINE_HEIGHT - int(h*SPARKLINE_HEIGHT/max)
+		}
+		points = append(points, fmt.Sprintf("%d,%d", i*step, y))
+	}
+	return strings.Join(points, " "), max
+}
+
+const DASHBOARD_TEMPLATE = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>eschecker</title>
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+<style>
+body { font-family: sans-serif; margin: 20px; color: #333; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 6px 10px; text-align: left; font-size: 14px; }
+th { background: #f4f4f4; }
+.state { font-weight: bold; padding: 2px 8px; border-radius: 3px; color: #fff; }
+.ok { background: #36a64f; }
+.alerting { background: #d00000; }
+.down, .suspended { background: #555; }
+.degraded { background: #e8a317; }
+.error { color: #d00000; max-width: 400px; overflow-wrap: break-word; }
+.severity-critical { color: #d00000; font-weight: bold; }
+polyline { fill: none; stroke: #4a90d9; stroke-width: 1.5; }
+form { margin-bottom: 15px; }
+h2 { margin-top: 30px; }
+</style>
+</head>
+<body>
+<h1>eschecker</h1>
+<form method="get">
+<input type="text" name="name" value="{{.Name}}" placeholder="query name">
+<select name="state">
+<option value="">all states</option>
+{{range .States}}<option value="{{.}}"{{if eq . $.State}} selected{{end}}>{{.}}</option>
+{{end}}</select>
+<input type="hidden" name="refresh" value="{{.Refresh}}">
+<input type="submit" value="Filter">
+{{len .Rows}} of {{.Total}} queries{{if .Refresh}}, refreshed every {{.Refresh}}s{{end}}
+</form>
+<table>
+<tr><th>Query</th><th>Severity</th><th>State</th><th>Last run</th><th>Next run</th><th>Last alert</th><th>Alerts</th><th>Hits</th><th>Last error</th></tr>
+{{range .Rows}}<tr>
+<td><a href="?name={{$.Name}}&amp;state={{$.State}}&amp;refresh={{$.Refresh}}&amp;history={{.Name}}">{{.Name}}</a></td>
+<td class="severity-{{.Severity}}">{{.Severity}}</td>
+<td><span class="state {{.State}}">{{.State}}</span>{{if ne .AckBy "None"}}<br><small>acknowledged by {{.AckBy}}</small>{{end}}</td>
+<td>{{.LastRun}}</td>
+<td>{{.NextRun}}</td>
+<td>{{.LastAlert}}</td>
+<td>{{.NbAlerts}}</td>
+<td>{{if .Sparkline}}<svg width="100" height="22" viewBox="0 -1 100 22"><polyline points="{{.Sparkline}}"/></svg> max {{.MaxHits}}{{end}}</td>
+<td class="error">{{if ne .LastError "None"}}{{.LastError}}{{end}}</td>
+</tr>
+{{end}}</table>
+{{if .History}}<h2>Alerts of {{.History}}</h2>
+{{if .Events}}<table>
+<tr><th>Time</th><th>Event</th><th>Alert</th><th>Hits</th><th>Duration</th><th>Notifications</th><th>Delivery</th></tr>
+{{range .Events}}<tr>
+<td>{{.Time.Format "Jan 2 15:04:05"}}</td>
+<td>{{.Type}}</td>
+<td>{{.AlertId}}</td>
+<td>{{.Hits}}</td>
+<td>{{.Duration}}{{if .AckBy}}<br><small>acknowledged by {{.AckBy}}</small>{{end}}</td>
+<td>{{if .Muted}}muted{{else}}{{range $i, $a := .Actions}}{{if $i}}, {{end}}{{$a}}{{end}}{{if gt .Notifications 1}} ({{.Notifications}} times){{end}}{{end}}</td>
+<td>{{.Delivery}}</td>
+</tr>
+{{end}}</table>
+{{else}}<p>No alert.</p>
+{{end}}{{end}}</body>
+</html>
+`
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/worker"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func initStatsForDashboard() {
+	stats.statsMap = make(map[string]queryStats)
+	stats.statsMap["errors"] = queryStats{IsUp: true, AlertStatus: true, Tries: 3, NbAlerts: 2, LastAlert: "Jan 2 15:04:05", LastError: "None",
+		LastRun: "Jan 2 15:04:05", NextRun: "Jan 2 15:05:05", Hits: []int64{1, 5, 3}, AlertId: "42", AckBy: "alice", AckAt: "Jan 2 15:04:10", Severity: "critical"}
+	stats.statsMap["latency"] = queryStats{IsUp: false, LastAlert: "None", Suspended: true, Timeouts: 3, LastError: "timeout error : <no response>",
+		LastRun: "Jan 2 15:04:05", NextRun: "Jan 2 16:04:05", AlertId: "None", AckBy: "None", AckAt: "None", Severity: "None"}
+	stats.statsMap["disk"] = queryStats{IsUp: true, Tries: 3, LastAlert: "None", LastError: "None", Degraded: true, PartialResults: 1,
+		LastRun: "Jan 2 15:04:05", NextRun: "Jan 2 15:05:05", Hits: []int64{0}, AlertId: "None", AckBy: "None", AckAt: "None", Severity: "None"}
+}
+
+func Test_Dashboard(t *testing.T) {
+	eslog.InitSilent()
+	initStatsForDashboard()
+
+	req := httptest.NewRequest("GET", "/escheck", nil)
+	page := getDashboardPage(req)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 3, len(page.Rows))
+	assert.Equal(t, "disk", page.Rows[0].Name)
+	assert.Equal(t, STATE_DEGRADED, page.Rows[0].State)
+	assert.Equal(t, STATE_ALERTING, page.Rows[1].State)
+	assert.Equal(t, STATE_SUSPENDED, page.Rows[2].State)
+	assert.Equal(t, DASHBOARD_REFRESH, page.Refresh)
+
+	//filtered by name and state
+	page = getDashboardPage(httptest.NewRequest("GET", "/escheck?name=LAT&refresh=0", nil))
+	assert.Equal(t, 1, len(page.Rows))
+	assert.Equal(t, "latency", page.Rows[0].Name)
+	assert.Equal(t, 0, page.Refresh)
+	page = getDashboardPage(httptest.NewRequest("GET", "/escheck?state=alerting", nil))
+	assert.Equal(t, 1, len(page.Rows))
+	assert.Equal(t, "errors", page.Rows[0].Name)
+	//with the alerts of a query
+	initHistoryForTests(t, "", 0)
+	historyStart("errors", "42", 5, []string{"email", "slack"}, false)
+	historyRepeat("errors")
+	page = getDashboardPage(httptest.NewRequest("GET", "/escheck?history=errors", nil))
+	assert.Equal(t, "errors", page.History)
+	assert.Equal(t, 1, len(page.Events))
+
+	//the page is rendered, with the errors escaped
+	worker.StartDispatcher(32)
+	ts := httptest.NewServer(http.HandlerFunc(collectorDashboard))
+	defer ts.Close()
+	res, err := http.Get(ts.URL)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.True(t, strings.Contains(string(content), "timeout error : &lt;no response&gt;"))
+	assert.True(t, strings.Contains(string(content), `<polyline points="0,16 50,0 100,8"/>`))
+	assert.True(t, strings.Contains(string(content), "acknowledged by alice"))
+	assert.True(t, strings.Contains(string(content), `<td class="severity-critical">critical</td>`))
+	assert.False(t, strings.Contains(string(content), "http://"))
+	assert.False(t, strings.Contains(string(content), "Alerts of"))
+	res, err = http.Get(ts.URL + "?history=errors")
+	assert.Nil(t, err)
+	content, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(content), "Alerts of errors"))
+	assert.True(t, strings.Contains(string(content), "email, slack (2 times)"))
+	worker.StopAllWorkers(32)
+}
+
+func Test_Sparkline(t *testing.T) {
+	points, max := getSparkline(nil)
+	assert.Equal(t, "", points)
+	points, max = getSparkline([]int64{0, 0})
+	assert.Equal(t, "0,20 100,20", points)
+	assert.Equal(t, int64(0), max)
+	points, max = getSparkline([]int64{2, 4})
+	assert.Equal(t, "0,10 100,0", points)
+	assert.Equal(t, int64(4), max)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/esmail"
+	"github.com/amundi/escheck/esslack"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+** In digest mode, the actions of a query don't send anything when an alert
+** starts or ends. The alerts and recoveries are collected, and a summary is sent
+** at the end of each period. The queries with the same period and the same
+** recipients share the same digest, so they are listed in the same summary. A
+** digest stops once no query uses it anymore.
+ */
+
+type digest struct {
+	period  time.Duration
+	mail    *esmail.Mail
+	slack   *esslack.SlackMsg
+	entries map[string]*digestEntry //by query name
+	queries map[string]bool         //the queries using it, g_digests must be locked
+	stop    chan struct{}
+	sync.Mutex
+}
+
+// what happened to a query during the period
+type digestEntry struct {
+	nbAlerts   int
+	peakHits   int64
+	alertStart time.Time       //zero if the query is not in alert
+	durations  []time.Duration //alerts that ended during the period
+}
+
+var g_digests = struct {
+	list map[string]*digest
+	sync.Mutex
+}{list: make(map[string]*digest)}
+
+// getDigest gives the digest matching the period and actions of the query, and
+// creates it if it doesn't exist yet
+func getDigest(name string, period time.Duration, info *config.Query) *digest {
+	key := getDigestKey(period, info)
+	g_digests.Lock()
+	defer g_digests.Unlock()
+	d, ok := g_digests.list[key]
+	if !ok {
+		d = newDigest(period, info)
+		g_digests.list[key] = d
+		go d.run()
+	}
+	d.queries[name] = true
+	return d
+}
+
+// useDigests tells the digests a query uses once configured. It leaves the
+// ones it used before, and the digests without any query left are stopped.
+func useDigests(name string, used []*digest) {
+	g_digests.Lock()
+	defer g_digests.Unlock()
+	for key, d := range g_digests.list {
+		if !d.queries[name] || containsDigest(used, d) {
+			continue
+		}
+		delete(d.queries, name)
+		if len(d.queries) == 0 {
+			delete(g_digests.list, key)
+			close(d.stop)
+		}
+	}
+}
+
+func containsDigest(list []*digest, d *digest) bool {
+	for _, item := range list {
+		if item == d {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDigestQuery removes a deleted query from the digests
+func removeDigestQuery(name string) {
+	g_digests.Lock()
+	for _, d := range g_digests.list {
+		d.Lock()
+		delete(d.entries, name)
+		d.Unlock()
+	}
+	g_digests.Unlock()
+	useDigests(name, nil)
+}
+
+// getDigestKey gives the period and all the settings the digest is sent with,
+// the queries sharing a digest must agree on every one of them
+func getDigestKey(period time.Duration, info *config.Query) string {
+	key := period.String()
+	for _, action := range info.Actions.List {
+		switch action {
+		case "email":
+			email := info.Actions.Email
+			key += "|email:" + joinSorted(email.To) + ";" + joinSorted(email.Cc) + ";" +
+				joinSorted(email.Bcc) + ";" + email.Reply_to
+		case "slack":
+			slack := info.Actions.Slack
+			key += "|slack:" + slack.User + ";" + slack.Channel + ";" + slack.Webhook
+		}
+	}
+	return key
+}
+
+func joinSorted(list []string) string {
+	sorted := append([]string{}, list...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func newDigest(period time.Duration, info *config.Query) *digest {
+	d := &digest{
+		period:  period,
+		entries: make(map[string]*digestEntry),
+		queries: make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+	for _, action := range info.Actions.List {
+		switch action {
+		case "email":
+			d.mail = esmail.NewMail()
+			d.mail.SetSubject("Digest of the last " + period.String())
+			d.mail.SetRecipients(info.Actions.Email.To)
+			d.mail.SetCc(info.Actions.Email.Cc)
+			d.mail.SetBcc(info.Actions.Email.Bcc)
+			d.mail.SetReplyTo(info.Actions.Email.Reply_to)
+		case "slack":
+			d.slack = esslack.NewSlackMsg("", info.Actions.Slack.User, info.Actions.Slack.Channel)
+			d.slack.SetWebhook(info.Actions.Slack.Webhook)
+		}
+	}
+	return d
+}
+
+func (d *digest) getEntry(name string) *digestEntry {
+	entry, ok := d.entries[name]
+	if !ok {
+		entry = new(digestEntry)
+		d.entries[name] = entry
+	}
+	return entry
+}
+
+// addAlert is called instead of sending the alert
+func (d *digest) addAlert(name string, hits int64) {
+	d.Lock()
+	defer d.Unlock()
+	entry := d.getEntry(name)
+	if entry.alertStart.IsZero() {
+		entry.alertStart = time.Now()
+		entry.nbAlerts++
+	}
+	if hits > entry.peakHits {
+		entry.peakHits = hits
+	}
+}
+
+// observe keeps the peak of hits of a query while it is in alert
+func (d *digest) observe(name string, hits int64) {
+	d.Lock()
+	defer d.Unlock()
+	if entry, ok := d.entries[name]; ok && !entry.alertStart.IsZero() && hits > entry.peakHits {
+		entry.peakHits = hits
+	}
+}
+
+// addRecovery is called instead of sending the end of alert
+func (d *digest) addRecovery(name string) {
+	d.Lock()
+	defer d.Unlock()
+	entry, ok := d.entries[name]
+	if !ok || entry.alertStart.IsZero() {
+		return
+	}
+	entry.durations = append(entry.durations, time.Since(entry.alertStart))
+	entry.alertStart = time.Time{}
+}
+
+// run sends the summary at the end of each period, and a last one when the
+// digest is stopped
+func (d *digest) run() {
+	ticker := time.NewTicker(d.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.flush()
+		case <-d.stop:
+			d.flush()
+			return
+		}
+	}
+}
+
+// flush sends the summary of the period, if something happened, and starts a
+// new period. The queries still in alert stay in the next one.
+func (d *digest) flush() {
+	d.Lock()
+	columns, rows := d.getSummary()
+	for name, entry := range d.entries {
+		if entry.alertStart.IsZero() {
+			delete(d.entries, name)
+		} else {
+			entry.nbAlerts = 0
+			entry.peakHits = 0
+			entry.durations = nil
+		}
+	}
+	d.Unlock()
+
+	if len(rows) == 0 {
+		return
+	}
+	text := fmt.Sprintf("%d queries were in alert during the last %s", len(rows), d.period)
+	if d.mail != nil {
+		d.mail.SetBody("<p>%s</p>%s", text, esmail.FormatTableHTML(columns, rows))
+		d.mail.Send()
+		d.mail.ResetBody()
+	}
+	if d.slack != nil {
+		d.slack.SetText(text)
+		d.slack.SetPreformatted(esslack.FormatTable(columns, rows))
+		d.slack.Send()
+	}
+}
+
+// getSummary gives a line per query: its number of alerts, peak of hits, the
+// durations of its alerts, and if it is still in alert. Must be called locked.
+func (d *digest) getSummary() ([]string, [][]string) {
+	columns := []string{"Query", "Alerts", "Peak hits", "Durations", "Status"}
+	rows := [][]string{}
+	names := make([]string, 0, len(d.entries))
+	for name := range d.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := d.entries[name]
+		durations := make([]string, 0, len(entry.durations)+1)
+		for _, duration := range entry.durations {
+			durations = append(durations, duration.Truncate(time.Second).String())
+		}
+		status := "OK"
+		if !entry.alertStart.IsZero() {
+			status = "ALERT"
+			durations = append(durations, "ongoing since "+entry.alertStart.Format(TIMELAYOUT))
+		}
+		rows = append(rows, []string{
+			name,
+			strconv.Itoa(entry.nbAlerts),
+			strconv.FormatInt(entry.peakHits, 10),
+			strings.Join(durations, ", "),
+			status,
+		})
+	}
+	return columns, rows
+}
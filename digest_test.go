@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/amundi/escheck/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDigestKey(t *testing.T) {
+	info1 := &config.Query{Actions: config.Actions{
+		List:  []string{"email", "slack"},
+		Email: config.Email{To: []string{"b@test.com", "a@test.com"}},
+		Slack: config.Slack{Channel: "#alerts"},
+	}}
+	info2 := &config.Query{Actions: config.Actions{
+		List:  []string{"email", "slack"},
+		Email: config.Email{To: []string{"a@test.com", "b@test.com"}},
+		Slack: config.Slack{Channel: "#alerts"},
+	}}
+	assert.Equal(t, getDigestKey(time.Hour, info1), getDigestKey(time.Hour, info2))
+	assert.NotEqual(t, getDigestKey(time.Hour, info1), getDigestKey(time.Minute, info2))
+	info2.Actions.Slack.Channel = "#other"
+	assert.NotEqual(t, getDigestKey(time.Hour, info1), getDigestKey(time.Hour, info2))
+	//every setting the digest is sent with counts
+	info2.Actions.Slack.Channel = "#alerts"
+	info2.Actions.Email.Cc = []string{"c@test.com"}
+	assert.NotEqual(t, getDigestKey(time.Hour, info1), getDigestKey(time.Hour, info2))
+	info2.Actions.Email.Cc = nil
+	info2.Actions.Slack.User = "bot"
+	assert.NotEqual(t, getDigestKey(time.Hour, info1), getDigestKey(time.Hour, info2))
+}
+
+func TestDigestQueries(t *testing.T) {
+	g_digests.Lock()
+	saved := g_digests.list
+	g_digests.list = make(map[string]*digest)
+	g_digests.Unlock()
+	t.Cleanup(func() {
+		g_digests.Lock()
+		g_digests.list = saved
+		g_digests.Unlock()
+	})
+	info := &config.Query{}
+
+	//shared by the queries with the same settings
+	d := getDigest("q1", time.Hour, info)
+	assert.Equal(t, d, getDigest("q2", time.Hour, info))
+	other := getDigest("q1", time.Minute, info)
+
+	//a query replaced without the digest leaves it
+	useDigests("q1", []*digest{other})
+	g_digests.Lock()
+	assert.Equal(t, 2, len(g_digests.list))
+	assert.Equal(t, map[string]bool{"q2": true}, d.queries)
+	g_digests.Unlock()
+
+	//the digests without any query left are stopped
+	removeDigestQuery("q2")
+	useDigests("q1", nil)
+	g_digests.Lock()
+	assert.Equal(t, 0, len(g_digests.list))
+	g_digests.Unlock()
+	_, open := <-d.stop
+	assert.False(t, open)
+	_, open = <-other.stop
+	assert.False(t, open)
+}
+
+func TestDigest(t *testing.T) {
+	d := newDigest(time.Hour, &config.Query{})
+
+	//nothing happened
+	_, rows := d.getSummary()
+	assert.Equal(t, 0, len(rows))
+
+	d.addAlert("query1", 10)
+	d.observe("query1", 42)
+	d.observe("query1", 12)
+	//observing a query not in alert does nothing
+	d.observe("query2", 1000)
+	d.addRecovery("query1")
+	d.addAlert("query1", 5)
+	d.addRecovery("query2")
+	d.addAlert("query2", 3)
+
+	columns, rows := d.getSummary()
+	assert.Equal(t, []string{"Query", "Alerts", "Peak hits", "Durations", "Status"}, columns)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, []string{"query1", "2", "42"}, rows[0][:3])
+	assert.Equal(t, "ALERT", rows[0][4])
+	assert.Contains(t, rows[0][3], "0s, ongoing since")
+	assert.Equal(t, []string{"query2", "1", "3"}, rows[1][:3])
+
+	//the queries still in alert stay for the next period
+	d.addRecovery("query2")
+	d.flush()
+	_, rows = d.getSummary()
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, []string{"query1", "0", "0"}, rows[0][:3])
+	assert.Equal(t, "ALERT", rows[0][4])
+	d.addRecovery("query1")
+	d.flush()
+	_, rows = d.getSummary()
+	assert.Equal(t, 0, len(rows))
+}
+
+func TestDigestRecovery(t *testing.T) {
+	initHistoryForTests(t, "", 0)
+	a := &autoQuery{name: "q1", digest: newDigest(time.Hour, &config.Query{})}
+	a.digest.addAlert("q1", 3)
+
+	//recorded at the end of the alert, without end message
+	schedule := &scheduler{alertState: true}
+	stopAlert(a, "q1", schedule, newQueryControl("q1", queryConfig{}, 0), 0)
+	assert.False(t, schedule.alertState)
+	_, rows := a.digest.getSummary()
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, "OK", rows[0][4])
+}
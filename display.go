@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/olivere/elastic.v2"
+	"sort"
+	"strings"
+)
+
+/*
+** Extraction of the fields of the documents found by a query, to display them
+** as a table in the notifications.
+ */
+
+const (
+	//the column holding the id of the documents
+	ID_COLUMN = "_id"
+)
+
+// getTable gives the columns and one row per document, with the value of each
+// field. Without fields, the columns are the id and the first level fields of
+// the documents.
+func getTable(hits []*elastic.SearchHit, fields []string) ([]string, [][]string) {
+	sources := make([]map[string]interface{}, len(hits))
+	for i, hit := range hits {
+		sources[i] = getSource(hit)
+	}
+	if len(fields) == 0 {
+		fields = getColumns(sources)
+	}
+	rows := make([][]string, len(hits))
+	for i, hit := range hits {
+		rows[i] = make([]string, len(fields))
+		for j, field := range fields {
+			if field == ID_COLUMN {
+				rows[i][j] = hit.Id
+			} else if value, ok := getFieldValue(sources[i], field); ok {
+				rows[i][j] = formatValue(value)
+			}
+		}
+	}
+	return fields, rows
+}
+
+func getSource(hit *elastic.SearchHit) map[string]interface{} {
+	var ret map[string]interface{}
+
+	if hit == nil || hit.Source == nil {
+		return nil
+	}
+	if err := json.Unmarshal(*hit.Source, &ret); err != nil {
+		return nil
+	}
+	return ret
+}
+
+// getFieldValue gets a field of a document. A dotted path gets into the nested
+// objects. A field whose name contains dots is found too.
+func getFieldValue(source map[string]interface{}, path string) (interface{}, bool) {
+	if source == nil {
+		return nil, false
+	}
+	if value, ok := source[path]; ok {
+		return value, true
+	}
+	parts := strings.Split(path, ".")
+	for i := 1; i < len(parts); i++ {
+		sub, ok := source[strings.Join(parts[:i], ".")].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if value, ok := getFieldValue(sub, strings.Join(parts[i:], ".")); ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	ret, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(ret)
+}
+
+func getColumns(sources []map[string]interface{}) []string {
+	ret := []string{}
+	seen := map[string]bool{}
+	for _, source := range sources {
+		for k := range source {
+			if !seen[k] {
+				seen[k] = true
+				ret = append(ret, k)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return append([]string{ID_COLUMN}, ret...)
+}
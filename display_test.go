@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"testing"
+)
+
+func TestGetTable(t *testing.T) {
+	hits := []*elastic.SearchHit{
+		newHitForTests("1", `{"status": 500, "host": {"name": "srv1"}}`),
+		newHitForTests("2", `{"status": 404}`),
+	}
+	columns, rows := getTable(hits, []string{"host.name", "status", ID_COLUMN})
+	assert.Equal(t, []string{"host.name", "status", "_id"}, columns)
+	assert.Equal(t, [][]string{{"srv1", "500", "1"}, {"", "404", "2"}}, rows)
+
+	columns, rows = getTable(hits, nil)
+	assert.Equal(t, []string{"_id", "host", "status"}, columns)
+	assert.Equal(t, []string{"2", "", "404"}, rows[1])
+}
+
+func TestGetFieldValue(t *testing.T) {
+	var source map[string]interface{}
+	json.Unmarshal([]byte(`{"a": {"b": {"c": 1}}, "a.d": 2, "e": null}`), &source)
+	value, ok := getFieldValue(source, "a.b.c")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, float64(1), value)
+	value, ok = getFieldValue(source, "a.d")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, float64(2), value)
+	_, ok = getFieldValue(source, "e")
+	assert.Equal(t, true, ok)
+	_, ok = getFieldValue(source, "a.b.z")
+	assert.Equal(t, false, ok)
+	_, ok = getFieldValue(nil, "a")
+	assert.Equal(t, false, ok)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/queries"
+	"gopkg.in/olivere/elastic.v2"
+	"sync"
+	"time"
+)
+
+/*
+** Escalation of the alerts nobody takes care of. A query can follow a policy of
+** the escalations section: a list of tiers, each with a delay and receivers. When
+** an alert is still active and not acknowledged after the delay of a tier, since
+** its start, the receivers of the tier are notified with the last results. The
+** escalated receivers get the end of alert too.
+ */
+
+const (
+	EVENT_ESCALATION = "escalation"
+)
+
+type escalationTier struct {
+	after     time.Duration //since the start of the alert
+	receivers []*autoQuery
+}
+
+type escalation struct {
+	name  string
+	tiers []escalationTier
+	//the current alert, the tiers passed and the receivers notified
+	alertId  string
+	ackLink  string
+	search   *elastic.SearchResult
+	control  *queryControl
+	level    int
+	notified []*autoQuery
+	timer    *time.Timer
+	sync.Mutex
+}
+
+// newEscalation creates the escalation of a query following the policy
+func (a *autoQuery) newEscalation(policy string, info *config.Query) (*escalation, error) {
+	tiers, ok := config.G_Config.Config.Escalations[policy]
+	if !ok {
+		return nil, errors.New("unknown escalation policy " + policy)
+	}
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("escalation policy %s has no tiers", policy)
+	}
+	ret := &escalation{name: a.name}
+	for i, tier := range tiers {
+		after, err := time.ParseDuration(tier.After)
+		if err != nil || after <= 0 {
+			return nil, fmt.Errorf("escalation policy %s, wrong delay %s for tier %d", policy, tier.After, i+1)
+		}
+		if i > 0 && after <= ret.tiers[i-1].after {
+			return nil, fmt.Errorf("escalation policy %s, the delays must increase", policy)
+		}
+		receivers, err := a.newReceivers(tier.Receivers, info)
+		if err != nil {
+			return nil, fmt.Errorf("escalation policy %s, %s", policy, err.Error())
+		}
+		if len(receivers) == 0 {
+			return nil, fmt.Errorf("escalation policy %s, no receivers for tier %d", policy, i+1)
+		}
+		ret.tiers = append(ret.tiers, escalationTier{after, receivers})
+	}
+	return ret, nil
+}
+
+// getEscalation gives the escalation of a query, nil if it has none
+func getEscalation(c queries.Query) *escalation {
+	if a, ok := c.(*autoQuery); ok {
+		return a.escalation
+	}
+	return nil
+}
+
+// start watches a new alert, until the first tier
+func (e *escalation) start(id string, ackLink string, search *elastic.SearchResult, control *queryControl) {
+	e.Lock()
+	defer e.Unlock()
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.alertId, e.ackLink, e.search, e.control = id, ackLink, search, control
+	e.level, e.notified = 0, nil
+	e.timer = time.AfterFunc(e.tiers[0].after, func() { e.escalate(id) })
+}
+
+// update keeps the last results of the alert, given to the next tiers
+func (e *escalation) update(search *elastic.SearchResult) {
+	e.Lock()
+	defer e.Unlock()
+	if e.alertId != "" {
+		e.search = search
+	}
+}
+
+// escalate notifies the next tier, if the alert id is still active and not
+// acknowledged
+func (e *escalation) escalate(id string) {
+	e.Lock()
+	defer e.Unlock()
+	if e.alertId != id || e.level >= len(e.tiers) {
+		return
+	}
+	if isAcked(e.name) {
+		eslog.Info("%s : alert acknowledged, not escalated", e.name)
+		return
+	}
+	tier := e.tiers[e.level]
+	e.level++
+	if e.control != nil && e.control.isMuted() {
+		eslog.Alert("%s : Escalation to tier %d not triggered, the query is muted", e.name, e.level)
+	} else {
+		eslog.Alert("%s : alert not acknowledged after %s, escalated to tier %d", e.name, tier.after, e.level)
+		var names []string
+		for _, r := range tier.receivers {
+			r.alertId, r.ackLink = e.alertId, e.ackLink
+			r.DoAction(e.search)
+			names = append(names, r.receiver)
+			e.notified = append(e.notified, r)
+		}
+		var hits int64
+		if e.search != nil && e.search.Hits != nil {
+			hits = e.search.Hits.TotalHits
+		}
+		addEvent(e.name, newAlertEvent(EVENT_ESCALATION, e.alertId, hits, names, false))
+	}
+	if e.level < len(e.tiers) {
+		e.timer = time.AfterFunc(e.tiers[e.level].after-tier.after, func() { e.escalate(id) })
+	}
+}
+
+// recordEnd records the end of the alert for the receivers escalated
+func (e *escalation) recordEnd() {
+	e.Lock()
+	defer e.Unlock()
+	for _, r := range e.notified {
+		r.alertId = e.alertId
+		r.recordEnd()
+	}
+}
+
+// stop forgets the alert. The receivers escalated get the end of alert if
+// endMsg.
+func (e *escalation) stop(endMsg bool) {
+	e.Lock()
+	defer e.Unlock()
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	if endMsg {
+		for _, r := range e.notified {
+			r.alertId = e.alertId
+			r.OnAlertEnd()
+		}
+	}
+	e.alertId, e.ackLink, e.search, e.level, e.notified = "", "", nil, 0, nil
+}
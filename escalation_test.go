@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"gopkg.in/yaml.v2"
+	"testing"
+	"time"
+)
+
+const testEscalation = `
+receivers:
+  team:
+    digest: 1h
+    list: [slack]
+    slack:
+      channel: "#escalation-team"
+  manager:
+    digest: 1h
+    list: [slack]
+    slack:
+      channel: "#escalation-manager"
+escalations:
+  standard:
+    - after: 1h
+      receivers: [team]
+    - after: 2h
+      receivers: [manager]
+querylist:
+  escalated:
+    escalation: standard
+    query:
+      index: logs*
+`
+
+// initEscalationForTests starts with empty alerts, history and digests, and
+// puts the previous ones back at the end of the test
+func initEscalationForTests(t *testing.T) *autoQuery {
+	eslog.InitSilent()
+	conf := config.G_Config.Config
+	g_acks.Lock()
+	acks := g_acks.list
+	g_acks.list = make(map[string]*alertAck)
+	g_acks.Unlock()
+	g_digests.Lock()
+	digests := g_digests.list
+	g_digests.list = make(map[string]*digest)
+	g_digests.Unlock()
+	g_history.Lock()
+	file, size, history, dirty := g_history.file, g_history.size, g_history.list, g_history.dirty
+	g_history.Unlock()
+	t.Cleanup(func() {
+		config.G_Config.Config = conf
+		g_acks.Lock()
+		g_acks.list = acks
+		g_acks.Unlock()
+		g_digests.Lock()
+		g_digests.list = digests
+		g_digests.Unlock()
+		g_history.Lock()
+		g_history.file, g_history.size, g_history.list, g_history.dirty = file, size, history, dirty
+		g_history.Unlock()
+	})
+	initHistoryForTests(t, "", 0)
+	config.G_Config.Config = new(config.Config)
+	assert.Nil(t, yaml.Unmarshal([]byte(testEscalation), config.G_Config.Config))
+	a := &autoQuery{name: "escalated"}
+	assert.Nil(t, a.setConfig())
+	return a
+}
+
+// getEscalated gives the number of alerts received by the receivers of a tier
+func getEscalated(e *escalation, tier int) int {
+	d := e.tiers[tier].receivers[0].digest
+	d.Lock()
+	defer d.Unlock()
+	if entry, ok := d.entries["escalated"]; ok {
+		return entry.nbAlerts
+	}
+	return 0
+}
+
+func Test_NewEscalation(t *testing.T) {
+	a := initEscalationForTests(t)
+	assert.NotNil(t, a.escalation)
+	assert.Equal(t, 2, len(a.escalation.tiers))
+	assert.Equal(t, 2*time.Hour, a.escalation.tiers[1].after)
+	assert.Equal(t, "manager", a.escalation.tiers[1].receivers[0].receiver)
+	assert.Equal(t, 0, len(checkRouting()))
+
+	//wrong policies
+	info := new(config.Query)
+	_, err := a.newEscalation("unknown", info)
+	assert.NotNil(t, err)
+	config.G_Config.Config.Escalations["empty"] = nil
+	config.G_Config.Config.Escalations["wrongdelay"] = []config.Tier{{After: "soon", Receivers: []string{"team"}}}
+	config.G_Config.Config.Escalations["decreasing"] = []config.Tier{
+		{After: "1h", Receivers: []string{"team"}}, {After: "5m", Receivers: []string{"manager"}}}
+	config.G_Config.Config.Escalations["noreceiver"] = []config.Tier{{After: "1h"}}
+	config.G_Config.Config.Escalations["unknownreceiver"] = []config.Tier{{After: "1h", Receivers: []string{"ceo"}}}
+	for _, policy := range []string{"empty", "wrongdelay", "decreasing", "noreceiver", "unknownreceiver"} {
+		_, err = a.newEscalation(policy, info)
+		assert.NotNil(t, err, policy)
+	}
+	assert.Equal(t, 5, len(checkRouting()))
+}
+
+func Test_Escalation(t *testing.T) {
+	var search elastic.SearchResult
+
+	a := initEscalationForTests(t)
+	e := a.escalation
+	json.Unmarshal([]byte(`{"hits":{"total":42,"hits":[]}}`), &search)
+	control := newQueryControl("escalated", queryConfig{}, time.Second)
+
+	//the tiers are notified one after the other, when their timer expires
+	id := startAlert("escalated")
+	defer endAlert("escalated")
+	e.start(id, "", &search, control)
+	assert.Equal(t, 0, getEscalated(e, 0))
+	e.escalate(id)
+	assert.Equal(t, 1, getEscalated(e, 0))
+	assert.Equal(t, 0, getEscalated(e, 1))
+	e.escalate(id)
+	assert.Equal(t, 1, getEscalated(e, 1))
+	events := getHistory("escalated")
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, EVENT_ESCALATION, events[0].Type)
+	assert.Equal(t, []string{"manager"}, events[0].Actions)
+	assert.Equal(t, int64(42), events[0].Hits)
+	//no tier left
+	e.escalate(id)
+	assert.Equal(t, 2, len(getHistory("escalated")))
+
+	//the escalated receivers get the end of alert, in their digest
+	e.recordEnd()
+	e.stop(true)
+	assert.Equal(t, "", e.alertId)
+	assert.Nil(t, e.notified)
+	assert.Nil(t, e.timer)
+	d := e.tiers[0].receivers[0].digest
+	d.Lock()
+	assert.Equal(t, 1, len(d.entries["escalated"].durations))
+	d.Unlock()
+
+	//an acknowledged alert is not escalated
+	endAlert("escalated")
+	id = startAlert("escalated")
+	e.start(id, "", &search, control)
+	ackAlert(id, "alice")
+	e.escalate(id)
+	e.Lock()
+	assert.Equal(t, 0, e.level)
+	e.Unlock()
+	e.stop(false)
+
+	//nor an alert that ended before the delay, or a previous one
+	e.start("other", "", &search, control)
+	e.stop(false)
+	e.escalate("other")
+	e.start("new", "", &search, control)
+	e.escalate("other")
+	e.stop(false)
+	assert.Equal(t, 2, len(getHistory("escalated")))
+
+	//a muted query passes the tiers without notifying
+	endAlert("escalated")
+	id = startAlert("escalated")
+	control.setMuted(true)
+	e.start(id, "", &search, control)
+	e.escalate(id)
+	e.Lock()
+	assert.Equal(t, 1, e.level)
+	assert.Nil(t, e.notified)
+	e.Unlock()
+	e.stop(true)
+	assert.Equal(t, 2, len(getHistory("escalated")))
+}
@@ -0,0 +1,115 @@
+package eshttp
+
+import (
+	"github.com/amundi/escheck/config"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+** Shared http clients for the integrations talking to the outside world (slack,
+** webhooks...). They all go through the same proxy, set in the yaml, unless they
+** have their own.
+ */
+
+const (
+	//use it as a proxy to disable any proxy, even the ones of the environment
+	NOPROXY = "none"
+	//a request hanging longer than this is given up, for the clients that don't
+	//set their own timeout
+	DEFAULT_TIMEOUT = 30 * time.Second
+)
+
+var g_proxy = struct {
+	url string
+}{}
+
+func Init() {
+	g_proxy.url = config.G_Config.Config.Proxy
+}
+
+// NewClient returns an http client going through the proxy given as parameter.
+// If it is empty, the global proxy of the yaml is used, and if there is none,
+// the HTTPS_PROXY and HTTP_PROXY environment variables. NO_PROXY is always
+// honoured. The transport is a copy of the default one, keeping its dial and
+// handshake timeouts.
+func NewClient(proxy string) (*http.Client, error) {
+	proxyFunc, err := GetProxyFunc(proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc
+	return &http.Client{
+		Transport: transport,
+		Timeout:   DEFAULT_TIMEOUT,
+	}, nil
+}
+
+func GetProxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		proxy = g_proxy.url
+	}
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case NOPROXY:
+		return nil, nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return func(r *http.Request) (*url.URL, error) {
+		if bypassProxy(r.URL.Host, getNoProxy()) {
+			return nil, nil
+		}
+		return proxyUrl, nil
+	}, nil
+}
+
+// bypassProxy tells if host matches the NO_PROXY list. It's a comma separated
+// list of hosts, domains (".example.com" or "example.com" also match the
+// subdomains), IPs, CIDRs, or "*" for everything.
+func bypassProxy(host string, noProxy string) bool {
+	if noProxy == "" {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case ip != nil && strings.Contains(entry, "/"):
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+		case host == strings.TrimPrefix(entry, "."):
+			return true
+		case strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")):
+			return true
+		}
+	}
+	return false
+}
+
+func getNoProxy() string {
+	if ret := os.Getenv("NO_PROXY"); ret != "" {
+		return ret
+	}
+	return os.Getenv("no_proxy")
+}
@@ -0,0 +1,66 @@
+package eshttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := "localhost, .internal.com,example.org,10.0.0.0/8, 192.168.1.1:8080"
+	assert.Equal(t, true, bypassProxy("localhost:9200", noProxy))
+	assert.Equal(t, true, bypassProxy("es.internal.com", noProxy))
+	assert.Equal(t, true, bypassProxy("internal.com", noProxy))
+	assert.Equal(t, true, bypassProxy("www.example.org:443", noProxy))
+	assert.Equal(t, true, bypassProxy("10.2.3.4:9200", noProxy))
+	assert.Equal(t, true, bypassProxy("192.168.1.1", noProxy))
+	assert.Equal(t, false, bypassProxy("hooks.slack.com", noProxy))
+	assert.Equal(t, false, bypassProxy("notexample.org", noProxy))
+	assert.Equal(t, false, bypassProxy("11.2.3.4", noProxy))
+	assert.Equal(t, false, bypassProxy("hooks.slack.com", ""))
+	assert.Equal(t, true, bypassProxy("hooks.slack.com", "*"))
+}
+
+func TestGetProxyFunc(t *testing.T) {
+	os.Setenv("NO_PROXY", "localhost")
+	defer os.Unsetenv("NO_PROXY")
+	req, _ := http.NewRequest("GET", "https://hooks.slack.com/services/abc", nil)
+	local, _ := http.NewRequest("GET", "http://localhost:9200", nil)
+
+	//global proxy
+	g_proxy.url = "http://proxy.corp:3128"
+	f, err := GetProxyFunc("")
+	assert.Nil(t, err)
+	u, err := f(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://proxy.corp:3128", u.String())
+	u, err = f(local)
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+
+	//override
+	f, err = GetProxyFunc("http://other.corp:8080")
+	assert.Nil(t, err)
+	u, _ = f(req)
+	assert.Equal(t, "http://other.corp:8080", u.String())
+
+	//disabled
+	f, err = GetProxyFunc(NOPROXY)
+	assert.Nil(t, err)
+	assert.Nil(t, f)
+
+	_, err = GetProxyFunc("http://bad url:%%")
+	assert.NotNil(t, err)
+
+	client, err := NewClient("")
+	assert.Nil(t, err)
+	assert.NotNil(t, client)
+	assert.Equal(t, DEFAULT_TIMEOUT, client.Timeout)
+	transport := client.Transport.(*http.Transport)
+	assert.NotNil(t, transport.Proxy)
+	//the default transport keeps its own proxy
+	assert.NotEqual(t, transport, http.DefaultTransport)
+	assert.NotZero(t, transport.TLSHandshakeTimeout)
+	g_proxy.url = ""
+}
@@ -1,53 +1,122 @@
 package esmail
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/amundi/escheck/config"
 	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/esoutbox"
 	"github.com/amundi/escheck/worker"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/smtp"
+	"net/textproto"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	TITLE          = "Alert Elastic: "
-	RN             = "\r\n"
-	BR             = "<br />"
-	MIME_VERSION   = "1.0"
-	CONTENT_TYPE   = "text/html; charset=\"utf-8\""
-	EMAIL_TEMPLATE = `<html><head><title>%s</title></head><body><center><h2>%s</h2></center>%s</body></html>`
+	TITLE        = "Alert Elastic: "
+	RN           = "\r\n"
+	BR           = "<br />"
+	MIME_VERSION = "1.0"
+	CONTENT_TYPE = "multipart/alternative"
+	//used instead of CONTENT_TYPE when there are attachments
+	CONTENT_TYPE_MIXED = "multipart/mixed"
+	EMAIL_TEMPLATE     = `<html><head><title>%s</title></head><body><center><h2>%s</h2></center>%s</body></html>`
+	//connection security
+	SECURITY_NONE     = "none"
+	SECURITY_TLS      = "tls"      //implicit TLS, usually on port 465
+	SECURITY_STARTTLS = "starttls" //plain connection upgraded to TLS, usually on port 587
+	//authentication methods
+	AUTH_PLAIN   = "plain"
+	AUTH_LOGIN   = "login"
+	AUTH_CRAMMD5 = "cram-md5"
+	DIAL_TIMEOUT = 30 * time.Second
+	//max length of the lines of base64 encoded attachments
+	BASE64_LINE_LEN = 76
+	//name of the mails in the outbox
+	KIND = "email"
 )
 
 var g_servinfo = struct {
-	server   string
-	port     int
-	username string
-	password string
+	server    string
+	port      int
+	username  string
+	password  string
+	security  string
+	auth      string
+	tlsConfig *tls.Config
 }{}
 
 type Mail struct {
 	subject string
 	body    string
 	to      []string
+	cc      []string
+	bcc     []string
 	Header  Header
+	//files joined to the mail
+	attachments []Attachment
+	origin      string //name of the query sending the mail
+}
+
+type Attachment struct {
+	Name        string
+	ContentType string //without parameters, like "text/csv"
+	Content     []byte
 }
 
 type Header struct {
 	from        string
 	to          []string
+	cc          []string
+	replyTo     string
 	subject     string
 	mimeVersion string
 	contentType string
 }
 
+// mail saved in the outbox when it can't be delivered
+type mailState struct {
+	Subject     string
+	Body        string
+	From        string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	ReplyTo     string
+	Attachments []Attachment
+	Origin      string
+}
+
 func Init() {
 	g_servinfo.server = config.G_Config.Config.Server
 	g_servinfo.port = config.G_Config.Config.Port
 	g_servinfo.username = config.G_Config.Config.Username
 	g_servinfo.password = config.G_Config.Config.Password
+	g_servinfo.security = strings.ToLower(config.G_Config.Config.Security)
+	g_servinfo.auth = strings.ToLower(config.G_Config.Config.Auth)
+	g_servinfo.tlsConfig = &tls.Config{
+		ServerName:         g_servinfo.server,
+		InsecureSkipVerify: config.G_Config.Config.Skip_verify,
+	}
+	if err := checkServInfo(); err != nil {
+		eslog.Error("%s : mailinfo : "+err.Error(), os.Args[0])
+	}
+	esoutbox.Register(KIND, decodeMail)
 }
 
 func NewMail() (ret *Mail) {
@@ -71,6 +140,20 @@ func (m *Mail) GetRecipients() []string {
 	return m.to
 }
 
+func (m *Mail) SetCc(cc []string) {
+	m.Header.cc = cc
+	m.cc = cc
+}
+
+// bcc recipients receive the mail, but don't appear in the header
+func (m *Mail) SetBcc(bcc []string) {
+	m.bcc = bcc
+}
+
+func (m *Mail) SetReplyTo(replyTo string) {
+	m.Header.replyTo = replyTo
+}
+
 func (m *Mail) SetSubject(subject string) {
 	m.Header.subject = TITLE + subject
 	m.subject = TITLE + subject
@@ -96,34 +179,258 @@ func (m *Mail) ResetBody() {
 	m.body = ""
 }
 
+func (m *Mail) AddAttachment(name string, contentType string, content []byte) {
+	m.attachments = append(m.attachments, Attachment{name, contentType, content})
+}
+
+func (m *Mail) GetAttachments() []Attachment {
+	return m.attachments
+}
+
+func (m *Mail) ResetAttachments() {
+	m.attachments = nil
+}
+
+func (m *Mail) SetOrigin(origin string) {
+	m.origin = origin
+}
+
 func (m *Mail) Send() {
 	collectorMail(*m)
 }
 
+// if the mail can't be sent, it goes to the outbox to be sent again later
 func (m Mail) DoRequest() {
-	var err error
+	esoutbox.Deliver(m)
+}
+
+func (m Mail) Deliver() error {
+	if err := m.send(); err != nil {
+		return fmt.Errorf("error sending mail to %s : %s", strings.Join(m.to, ", "), err.Error())
+	}
+	return nil
+}
+
+func (m Mail) Origin() string {
+	return m.origin
+}
+
+func (m Mail) Kind() string {
+	return KIND
+}
+
+func (m Mail) MarshalJSON() ([]byte, error) {
+	return json.Marshal(mailState{
+		Subject:     m.subject,
+		Body:        m.body,
+		From:        m.Header.from,
+		To:          m.to,
+		Cc:          m.cc,
+		Bcc:         m.bcc,
+		ReplyTo:     m.Header.replyTo,
+		Attachments: m.attachments,
+		Origin:      m.origin,
+	})
+}
+
+// decodeMail gives back a mail saved in the outbox
+func decodeMail(data []byte) (esoutbox.Notification, error) {
+	var state mailState
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	m := NewMail()
+	m.SetFrom(state.From)
+	m.SetRecipients(state.To)
+	m.SetCc(state.Cc)
+	m.SetBcc(state.Bcc)
+	m.SetReplyTo(state.ReplyTo)
+	//the title is already in the saved subject
+	m.subject = state.Subject
+	m.Header.subject = state.Subject
+	m.body = state.Body
+	m.attachments = state.Attachments
+	m.origin = state.Origin
+	return *m, nil
+}
+
+func (m Mail) send() error {
+	msg, err := m.getMessage()
+	if err != nil {
+		return err
+	}
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
 
 	if isAuth() {
-		err = smtp.SendMail(
-			g_servinfo.server+":"+strconv.Itoa(g_servinfo.port),
-			getAuth(),
-			g_servinfo.username,
-			m.to,
-			[]byte(m.Header.getFullHeader()+fmt.Sprintf(EMAIL_TEMPLATE, m.subject, m.subject, m.body)+RN),
-		)
+		if err = c.Auth(getAuth()); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(g_servinfo.username); err != nil {
+		return err
+	}
+	for _, rcpt := range m.getAllRecipients() {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dial connects to the mail server with the right security. Without security
+// set in the yaml, STARTTLS is used if the server supports it, like smtp.SendMail
+func dial() (*smtp.Client, error) {
+	var conn net.Conn
+	var err error
+
+	addr := g_servinfo.server + ":" + strconv.Itoa(g_servinfo.port)
+	if g_servinfo.security == SECURITY_TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: DIAL_TIMEOUT}, "tcp", addr, g_servinfo.tlsConfig)
 	} else {
-		err = smtp.SendMail(
-			g_servinfo.server+":"+strconv.Itoa(g_servinfo.port),
-			nil,
-			g_servinfo.username,
-			m.to,
-			[]byte(m.Header.getFullHeader()+fmt.Sprintf(EMAIL_TEMPLATE, m.subject, m.subject, m.body)+RN),
-		)
+		conn, err = net.DialTimeout("tcp", addr, DIAL_TIMEOUT)
+	}
+	if err != nil {
+		return nil, err
 	}
+	c, err := smtp.NewClient(conn, g_servinfo.server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch g_servinfo.security {
+	case SECURITY_STARTTLS, "":
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			err = c.StartTLS(g_servinfo.tlsConfig)
+		} else if g_servinfo.security == SECURITY_STARTTLS {
+			err = errors.New("server doesn't support STARTTLS")
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (m Mail) getAllRecipients() []string {
+	ret := make([]string, 0, len(m.to)+len(m.cc)+len(m.bcc))
+	ret = append(ret, m.to...)
+	ret = append(ret, m.cc...)
+	return append(ret, m.bcc...)
+}
 
+// getMessage builds the whole mail: the header, then a plain text and an html
+// version of the body. If there are attachments, the two versions of the body
+// are the first part of a multipart/mixed, followed by the files.
+func (m Mail) getMessage() ([]byte, error) {
+	var buf bytes.Buffer
+
+	body, contentType, err := m.getAlternative()
 	if err != nil {
-		eslog.Error("%s : error sending mail : "+err.Error(), os.Args[0])
+		return nil, err
+	}
+	if len(m.attachments) > 0 {
+		mixed := new(bytes.Buffer)
+		w := multipart.NewWriter(mixed)
+		part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(body); err != nil {
+			return nil, err
+		}
+		for _, a := range m.attachments {
+			if err = writeAttachment(w, a); err != nil {
+				return nil, err
+			}
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		body = mixed.Bytes()
+		contentType = CONTENT_TYPE_MIXED + "; boundary=\"" + w.Boundary() + "\""
 	}
+	buf.WriteString(m.Header.getFullHeader())
+	buf.WriteString("Content-Type: " + contentType + RN + RN)
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// getAlternative gives the plain text and html versions of the body, and
+// their content type
+func (m Mail) getAlternative() ([]byte, string, error) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	err := writePart(w, "text/plain; charset=\"utf-8\"", HTMLToText(m.body))
+	if err != nil {
+		return nil, "", err
+	}
+	err = writePart(w, "text/html; charset=\"utf-8\"", fmt.Sprintf(EMAIL_TEMPLATE, m.subject, m.subject, m.body))
+	if err != nil {
+		return nil, "", err
+	}
+	if err = w.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), m.Header.contentType + "; boundary=\"" + w.Boundary() + "\"", nil
+}
+
+func writeAttachment(w *multipart.Writer, a Attachment) error {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	params := map[string]string{"name": a.Name}
+	if strings.HasPrefix(contentType, "text/") {
+		params["charset"] = "utf-8"
+	}
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, params)},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(a.Content)
+	for len(encoded) > BASE64_LINE_LEN {
+		if _, err = part.Write([]byte(encoded[:BASE64_LINE_LEN] + RN)); err != nil {
+			return err
+		}
+		encoded = encoded[BASE64_LINE_LEN:]
+	}
+	_, err = part.Write([]byte(encoded + RN))
+	return err
+}
+
+func writePart(w *multipart.Writer, contentType string, content string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err = qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
 }
 
 func collectorMail(m Mail) {
@@ -148,18 +455,78 @@ func FormatResultsHTML(res interface{}) string {
 	return string(pretty)
 }
 
+// FormatTableHTML displays rows of values as an html table
+func FormatTableHTML(columns []string, rows [][]string) string {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<table border="1" cellpadding="4" style="border-collapse:collapse"><tr>`)
+	for _, column := range columns {
+		buf.WriteString("<th>" + html.EscapeString(column) + "</th>")
+	}
+	buf.WriteString("</tr>")
+	for _, row := range rows {
+		buf.WriteString("<tr>")
+		for _, value := range row {
+			buf.WriteString("<td>" + html.EscapeString(value) + "</td>")
+		}
+		buf.WriteString("</tr>")
+	}
+	buf.WriteString("</table>")
+	return buf.String()
+}
+
+var (
+	lineBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</h[1-6]>|</tr>|</div>`)
+	cells      = regexp.MustCompile(`(?i)</t[dh]>`)
+	tags       = regexp.MustCompile(`<[^>]*>`)
+)
+
+// HTMLToText gives a plain text version of an html body, for the mail clients
+// that don't display html
+func HTMLToText(body string) string {
+	ret := lineBreaks.ReplaceAllString(body, "\n")
+	ret = cells.ReplaceAllString(ret, "\t")
+	ret = tags.ReplaceAllString(ret, "")
+	return html.UnescapeString(ret)
+}
+
+// the Content-Type is written with the boundary of the parts, by getMessage
 func (h Header) getFullHeader() string {
 	if h.subject == "" {
 		h.subject = "Alert ElasticSearch"
 	}
-	return "From: " + h.from + RN +
-		"To: " + strings.Join(h.to, ", ") + RN +
-		"Subject: " + h.subject + RN +
-		"MIME-Version: " + h.mimeVersion + RN +
-		"Content-Type: " + h.contentType + RN + RN
+	ret := "From: " + h.from + RN +
+		"To: " + strings.Join(h.to, ", ") + RN
+	if len(h.cc) > 0 {
+		ret += "Cc: " + strings.Join(h.cc, ", ") + RN
+	}
+	if h.replyTo != "" {
+		ret += "Reply-To: " + h.replyTo + RN
+	}
+	return ret +
+		"Subject: " + mime.QEncoding.Encode("utf-8", h.subject) + RN +
+		"Date: " + time.Now().Format(time.RFC1123Z) + RN +
+		"Message-ID: " + newMessageId() + RN +
+		"MIME-Version: " + h.mimeVersion + RN
+}
+
+func newMessageId() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	host := g_servinfo.server
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." + hex.EncodeToString(random) + "@" + host + ">"
 }
 
 func getAuth() smtp.Auth {
+	switch g_servinfo.auth {
+	case AUTH_LOGIN:
+		return &loginAuth{g_servinfo.username, g_servinfo.password, g_servinfo.server}
+	case AUTH_CRAMMD5:
+		return smtp.CRAMMD5Auth(g_servinfo.username, g_servinfo.password)
+	}
 	return smtp.PlainAuth("",
 		g_servinfo.username,
 		g_servinfo.password,
@@ -170,3 +537,52 @@ func getAuth() smtp.Auth {
 func isAuth() bool {
 	return len(g_servinfo.username) > 0 && len(g_servinfo.password) > 0
 }
+
+func checkServInfo() error {
+	switch g_servinfo.security {
+	case "", SECURITY_NONE, SECURITY_TLS, SECURITY_STARTTLS:
+	default:
+		return fmt.Errorf("unknown security %s, only: none, tls, starttls", g_servinfo.security)
+	}
+	switch g_servinfo.auth {
+	case "", AUTH_PLAIN, AUTH_LOGIN, AUTH_CRAMMD5:
+	default:
+		return fmt.Errorf("unknown auth %s, only: plain, login, cram-md5", g_servinfo.auth)
+	}
+	return nil
+}
+
+// the LOGIN authentication, not in net/smtp. Like PLAIN, it sends the password,
+// so it is refused on unencrypted connections, except on localhost
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %s", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -1,8 +1,30 @@
 package esmail
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/amundi/escheck/eslog"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewMail(t *testing.T) {
@@ -30,6 +52,36 @@ func TestSetters(t *testing.T) {
 	test.SetSubject("Danger !")
 	assert.Equal(t, "Alert Elastic: Danger !", test.subject)
 	assert.Equal(t, "Alert Elastic: Danger !", test.Header.subject)
+	test.SetCc([]string{"boss@lol.com"})
+	test.SetBcc([]string{"spy@lol.com"})
+	assert.Equal(t, []string{"boss@lol.com"}, test.Header.cc)
+	assert.Equal(t, []string{"john@lol.com", "kimiko@lol.com", "boss@lol.com", "spy@lol.com"}, test.getAllRecipients())
+}
+
+func TestOutboxState(t *testing.T) {
+	m := NewMail()
+	m.SetFrom("query1")
+	m.SetRecipients([]string{"john@lol.com"})
+	m.SetCc([]string{"boss@lol.com"})
+	m.SetBcc([]string{"spy@lol.com"})
+	m.SetReplyTo("team@lol.com")
+	m.SetSubject("Danger !")
+	m.SetBody("<p>%d hits</p>", 42)
+	m.AddAttachment("query1.csv", "text/csv", []byte("a,b\n1,2\n"))
+	m.SetOrigin("query1")
+
+	data, err := m.MarshalJSON()
+	assert.Nil(t, err)
+	n, err := decodeMail(data)
+	assert.Nil(t, err)
+	decoded := n.(Mail)
+	assert.Equal(t, "query1", decoded.Origin())
+	assert.Equal(t, KIND, decoded.Kind())
+	assert.Equal(t, m.Header, decoded.Header)
+	assert.Equal(t, m.getAllRecipients(), decoded.getAllRecipients())
+	assert.Equal(t, "Alert Elastic: Danger !", decoded.GetSubject())
+	assert.Equal(t, m.GetBody(), decoded.GetBody())
+	assert.Equal(t, m.GetAttachments(), decoded.GetAttachments())
 }
 
 func TestGetFullHeader(t *testing.T) {
@@ -41,9 +93,328 @@ func TestGetFullHeader(t *testing.T) {
 
 	expected := "From: Roberto" + RN +
 		"To: john@lol.com, kimiko@lol.com" + RN +
-		"Subject: Alert Elastic: Hello mate !" + RN +
-		"MIME-Version: 1.0" + RN +
-		"Content-Type: text/html; charset=\"utf-8\"" + RN + RN
+		"Subject: Alert Elastic: Hello mate !" + RN
+	header := test.Header.getFullHeader()
+	assert.Equal(t, true, strings.HasPrefix(header, expected))
+	assert.Contains(t, header, "Date: ")
+	assert.Contains(t, header, "Message-ID: <")
+	assert.Contains(t, header, "MIME-Version: 1.0"+RN)
+
+	test.SetCc([]string{"boss@lol.com"})
+	test.SetReplyTo("team@lol.com")
+	test.SetSubject("Problème d'indexation")
+	header = test.Header.getFullHeader()
+	assert.Contains(t, header, "Cc: boss@lol.com"+RN)
+	assert.Contains(t, header, "Reply-To: team@lol.com"+RN)
+	assert.Contains(t, header, "Subject: =?utf-8?q?Alert_Elastic:_Probl=C3=A8me_d'indexation?="+RN)
+}
+
+func TestGetMessage(t *testing.T) {
+	test := NewMail()
+	test.SetRecipients([]string{"john@lol.com"})
+	test.SetSubject("Problème")
+	test.SetBody("<p>Les sanglots longs</p><p>des violons &amp; de l'automne</p>")
+	raw, err := test.getMessage()
+	assert.Nil(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	assert.Nil(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Alert Elastic: Problème", subject)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := reader.NextPart()
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain; charset=\"utf-8\"", part.Header.Get("Content-Type"))
+	content, _ := ioutil.ReadAll(part)
+	assert.Equal(t, "Les sanglots longs\r\ndes violons & de l'automne\r\n", string(content))
+	part, err = reader.NextPart()
+	assert.Nil(t, err)
+	assert.Equal(t, "text/html; charset=\"utf-8\"", part.Header.Get("Content-Type"))
+	content, _ = ioutil.ReadAll(part)
+	assert.Contains(t, string(content), "<p>Les sanglots longs</p>")
+}
+
+func TestGetMessageWithAttachment(t *testing.T) {
+	test := NewMail()
+	test.SetRecipients([]string{"john@lol.com"})
+	test.SetBody("<p>see the file</p>")
+	test.AddAttachment("results.csv", "text/csv", []byte("_id,status\n1,500\n"))
+	assert.Equal(t, 1, len(test.GetAttachments()))
+	raw, err := test.getMessage()
+	assert.Nil(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	assert.Nil(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := reader.NextPart()
+	assert.Nil(t, err)
+	mediaType, _, err = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	part, err = reader.NextPart()
+	assert.Nil(t, err)
+	assert.Equal(t, "results.csv", part.FileName())
+	assert.Equal(t, "base64", part.Header.Get("Content-Transfer-Encoding"))
+	content, _ := ioutil.ReadAll(part)
+	decoded, err := base64.StdEncoding.DecodeString(strings.Replace(string(content), RN, "", -1))
+	assert.Nil(t, err)
+	assert.Equal(t, "_id,status\n1,500\n", string(decoded))
+	_, err = reader.NextPart()
+	assert.NotNil(t, err)
+
+	test.ResetAttachments()
+	assert.Equal(t, 0, len(test.GetAttachments()))
+}
+
+func TestFormatTableHTML(t *testing.T) {
+	table := FormatTableHTML([]string{"host", "status"}, [][]string{{"srv<1>", "500"}})
+	assert.Contains(t, table, "<th>host</th><th>status</th>")
+	assert.Contains(t, table, "<tr><td>srv&lt;1&gt;</td><td>500</td></tr>")
+	assert.Equal(t, "host\tstatus\t\nsrv<1>\t500\t\n", HTMLToText(table))
+}
+
+func TestSendNoSecurity(t *testing.T) {
+	for _, auth := range []string{AUTH_PLAIN, AUTH_LOGIN, AUTH_CRAMMD5} {
+		srv := newFakeSMTPServer(t, nil, false)
+		initServInfoForTests(srv, SECURITY_NONE, auth)
+		test := NewMail()
+		test.SetRecipients([]string{"john@lol.com"})
+		test.SetCc([]string{"boss@lol.com"})
+		test.SetBcc([]string{"spy@lol.com"})
+		test.SetSubject("test " + auth)
+		test.SetBody("Hello")
+		err := test.send()
+		assert.Nil(t, err, auth)
+		srv.close()
+		assert.Equal(t, "rob@hello.com", srv.from)
+		assert.Equal(t, []string{"john@lol.com", "boss@lol.com", "spy@lol.com"}, srv.rcpt)
+		assert.Equal(t, "rob@hello.com:secretz", srv.auth, auth)
+		assert.Contains(t, srv.data, "Subject: Alert Elastic: test "+auth)
+		assert.NotContains(t, srv.data, "spy@lol.com")
+		assert.Equal(t, false, srv.tls)
+	}
+}
+
+func TestSendWithTLS(t *testing.T) {
+	cert, pool := newCertForTests(t)
+
+	//implicit tls
+	srv := newFakeSMTPServer(t, &tls.Config{Certificates: []tls.Certificate{cert}}, false)
+	initServInfoForTests(srv, SECURITY_TLS, AUTH_PLAIN)
+	g_servinfo.tlsConfig.RootCAs = pool
+	test := NewMail()
+	test.SetRecipients([]string{"john@lol.com"})
+	test.SetBody("Hello")
+	assert.Nil(t, test.send())
+	srv.close()
+	assert.Equal(t, true, srv.tls)
+	assert.Equal(t, "rob@hello.com:secretz", srv.auth)
+
+	//starttls
+	srv = newFakeSMTPServer(t, &tls.Config{Certificates: []tls.Certificate{cert}}, true)
+	initServInfoForTests(srv, SECURITY_STARTTLS, AUTH_LOGIN)
+	g_servinfo.tlsConfig.RootCAs = pool
+	assert.Nil(t, test.send())
+	srv.close()
+	assert.Equal(t, true, srv.tls)
+	assert.Equal(t, "rob@hello.com:secretz", srv.auth)
+
+	//starttls required, but not supported by the server
+	srv = newFakeSMTPServer(t, nil, false)
+	initServInfoForTests(srv, SECURITY_STARTTLS, AUTH_PLAIN)
+	assert.NotNil(t, test.send())
+	srv.close()
+
+	//certificate not trusted
+	srv = newFakeSMTPServer(t, &tls.Config{Certificates: []tls.Certificate{cert}}, true)
+	initServInfoForTests(srv, SECURITY_STARTTLS, AUTH_PLAIN)
+	assert.NotNil(t, test.send())
+	srv.close()
+}
+
+func TestCheckServInfo(t *testing.T) {
+	g_servinfo.security = "ssl"
+	g_servinfo.auth = ""
+	assert.NotNil(t, checkServInfo())
+	g_servinfo.security = SECURITY_STARTTLS
+	g_servinfo.auth = "ntlm"
+	assert.NotNil(t, checkServInfo())
+	g_servinfo.auth = AUTH_CRAMMD5
+	assert.Nil(t, checkServInfo())
+}
+
+func initServInfoForTests(srv *fakeSMTPServer, security string, auth string) {
+	eslog.InitSilent()
+	host, port, _ := net.SplitHostPort(srv.addr)
+	g_servinfo.server = host
+	g_servinfo.port, _ = strconv.Atoi(port)
+	g_servinfo.username = "rob@hello.com"
+	g_servinfo.password = "secretz"
+	g_servinfo.security = security
+	g_servinfo.auth = auth
+	g_servinfo.tlsConfig = &tls.Config{ServerName: host}
+}
+
+/*
+** A very small SMTP server, just enough to receive one mail per connection and
+** remember what it received.
+ */
+
+type fakeSMTPServer struct {
+	t         *testing.T
+	listener  net.Listener
+	addr      string
+	tlsConfig *tls.Config
+	starttls  bool
+	wg        sync.WaitGroup
+	//what was received
+	tls  bool
+	auth string
+	from string
+	rcpt []string
+	data string
+}
+
+func newFakeSMTPServer(t *testing.T, tlsConfig *tls.Config, starttls bool) *fakeSMTPServer {
+	var l net.Listener
+	var err error
+
+	if tlsConfig != nil && !starttls {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{t: t, listener: l, addr: l.Addr().String(), tlsConfig: tlsConfig, starttls: starttls}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *fakeSMTPServer) serve() {
+	defer s.wg.Done()
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, s.tls = conn.(*tls.Conn)
+	r := bufio.NewReader(conn)
+	write := func(line string) { conn.Write([]byte(line + RN)) }
+	read := func() string {
+		line, _ := r.ReadString('\n')
+		return strings.TrimRight(line, RN)
+	}
+	decode := func(b64 string) string {
+		ret, _ := base64.StdEncoding.DecodeString(b64)
+		return string(ret)
+	}
+
+	write("220 fake ESMTP")
+	for {
+		line := read()
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case cmd == "EHLO":
+			write("250-fake")
+			if s.starttls && !s.tls {
+				write("250-STARTTLS")
+			}
+			write("250 AUTH PLAIN LOGIN CRAM-MD5")
+		case cmd == "STARTTLS":
+			write("220 go ahead")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			s.tls = true
+			r = bufio.NewReader(conn)
+		case strings.HasPrefix(strings.ToUpper(line), "AUTH PLAIN"):
+			parts := strings.Split(decode(strings.Fields(line)[2]), "\x00")
+			s.auth = parts[1] + ":" + parts[2]
+			write("235 ok")
+		case strings.HasPrefix(strings.ToUpper(line), "AUTH LOGIN"):
+			write("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+			user := decode(read())
+			write("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+			s.auth = user + ":" + decode(read())
+			write("235 ok")
+		case strings.HasPrefix(strings.ToUpper(line), "AUTH CRAM-MD5"):
+			challenge := "<1234.5678@fake>"
+			write("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+			answer := strings.Fields(decode(read()))
+			mac := hmac.New(md5.New, []byte("secretz"))
+			mac.Write([]byte(challenge))
+			if len(answer) == 2 && answer[1] == hex.EncodeToString(mac.Sum(nil)) {
+				s.auth = answer[0] + ":secretz"
+			}
+			write("235 ok")
+		case cmd == "MAIL":
+			s.from = strings.Trim(strings.SplitN(line, ":", 2)[1], "<> ")
+			write("250 ok")
+		case cmd == "RCPT":
+			s.rcpt = append(s.rcpt, strings.Trim(strings.SplitN(line, ":", 2)[1], "<> "))
+			write("250 ok")
+		case cmd == "DATA":
+			write("354 go ahead")
+			for l := read(); l != "."; l = read() {
+				s.data += l + "\n"
+			}
+			write("250 ok")
+		case cmd == "QUIT":
+			write("221 bye")
+			return
+		case line == "":
+			return
+		default:
+			write("502 not implemented")
+		}
+	}
+}
 
-	assert.Equal(t, expected, test.Header.getFullHeader())
+// self-signed certificate for 127.0.0.1, and the pool to trust it
+func newCertForTests(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		Subject:               pkix.Name{CommonName: "fake smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
 }
@@ -0,0 +1,342 @@
+package esoutbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/worker"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+** The outbox keeps the notifications (mails, slack messages...) that failed to
+** be delivered, and tries again later, waiting longer and longer between the
+** attempts. If a path is set in the yaml, the pending notifications are saved
+** on disk, so they are sent even if eschecker restarts.
+ */
+
+const (
+	DEFAULT_MAX_AGE   = 24 * time.Hour
+	DEFAULT_RETRY_MIN = 30 * time.Second
+	DEFAULT_RETRY_MAX = 30 * time.Minute
+	//how often the outbox looks for notifications to send again
+	TICK      = time.Second
+	EXTENSION = ".json"
+)
+
+// Notification is something to deliver, that can fail
+type Notification interface {
+	Deliver() error
+	//the name of the query that sent the notification, can be empty
+	Origin() string
+}
+
+// Persistable notifications can be saved on disk. Kind is the name used to find
+// the function decoding them, see Register.
+type Persistable interface {
+	Notification
+	Kind() string
+	json.Marshaler
+}
+
+type entry struct {
+	Id       string
+	Kind     string
+	Created  time.Time
+	Attempts int
+	NextTry  time.Time
+	Payload  json.RawMessage
+	//not saved
+	notification Notification
+	sending      bool
+}
+
+var g_outbox = struct {
+	path     string
+	maxAge   time.Duration
+	retryMin time.Duration
+	retryMax time.Duration
+	entries  map[string]*entry
+	decoders map[string]func([]byte) (Notification, error)
+	//called on each failed attempt, and when a notification is given up
+	onFailure func(origin string, dropped bool, err error)
+	onSuccess func(origin string)
+	started   sync.Once
+	sync.Mutex
+}{
+	decoders: make(map[string]func([]byte) (Notification, error)),
+}
+
+// Register gives the function to decode the notifications of a kind saved on disk
+func Register(kind string, decode func([]byte) (Notification, error)) {
+	g_outbox.Lock()
+	defer g_outbox.Unlock()
+	g_outbox.decoders[kind] = decode
+}
+
+// SetFailureHandler sets a function called each time a delivery fails. dropped
+// is true if the notification is given up.
+func SetFailureHandler(f func(origin string, dropped bool, err error)) {
+	g_outbox.Lock()
+	defer g_outbox.Unlock()
+	g_outbox.onFailure = f
+}
+
+// SetSuccessHandler sets a function called when a notification that failed
+// before is finally delivered
+func SetSuccessHandler(f func(origin string)) {
+	g_outbox.Lock()
+	defer g_outbox.Unlock()
+	g_outbox.onSuccess = f
+}
+
+// Init reads the configuration, loads the notifications saved on disk, and
+// starts to retry them. Register must be called before.
+func Init() error {
+	var err error
+
+	info := config.G_Config.Config.Outbox
+	g_outbox.Lock()
+	g_outbox.entries = make(map[string]*entry)
+	g_outbox.path = info.Path
+	g_outbox.maxAge, err = parseDuration(info.Max_age, DEFAULT_MAX_AGE)
+	if err == nil {
+		g_outbox.retryMin, err = parseDuration(info.Retry_min, DEFAULT_RETRY_MIN)
+	}
+	if err == nil {
+		g_outbox.retryMax, err = parseDuration(info.Retry_max, DEFAULT_RETRY_MAX)
+	}
+	if err == nil && g_outbox.path != "" {
+		err = load()
+	}
+	g_outbox.Unlock()
+	g_outbox.started.Do(func() { go run() })
+	return err
+}
+
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	ret, err := time.ParseDuration(value)
+	if err == nil && ret <= 0 {
+		err = fmt.Errorf("duration must be positive, got %s", value)
+	}
+	if err != nil {
+		return defaultValue, err
+	}
+	return ret, nil
+}
+
+// Deliver tries to deliver the notification. If it fails, it is put in the
+// outbox to be tried again later. To be called by the workers.
+func Deliver(n Notification) {
+	err := n.Deliver()
+	if err == nil {
+		return
+	}
+	notifyFailure(n.Origin(), false, err)
+
+	g_outbox.Lock()
+	defer g_outbox.Unlock()
+	if g_outbox.entries == nil {
+		//outbox not initialized, nothing more to do
+		eslog.Error("%s : notification failed, %s", os.Args[0], err.Error())
+		return
+	}
+	e := &entry{Id: newId(), Created: time.Now(), Attempts: 1, notification: n}
+	e.NextTry = time.Now().Add(getBackoff(e.Attempts))
+	if p, ok := n.(Persistable); ok && g_outbox.path != "" {
+		e.Kind = p.Kind()
+		if e.Payload, err = p.MarshalJSON(); err == nil {
+			err = save(e)
+		}
+		if err != nil {
+			eslog.Error("%s : failed to save the notification in the outbox, %s", os.Args[0], err.Error())
+		}
+	}
+	g_outbox.entries[e.Id] = e
+	eslog.Warning("%s : notification failed, trying again in %s", os.Args[0], e.NextTry.Sub(time.Now()).Truncate(time.Second))
+}
+
+// Pending gives the number of notifications waiting to be sent again
+func Pending() int {
+	g_outbox.Lock()
+	defer g_outbox.Unlock()
+	return len(g_outbox.entries)
+}
+
+// getBackoff doubles the waiting time after each attempt, up to retryMax
+func getBackoff(attempts int) time.Duration {
+	ret := g_outbox.retryMin
+	for i := 1; i < attempts && ret < g_outbox.retryMax; i++ {
+		ret *= 2
+	}
+	if ret > g_outbox.retryMax {
+		ret = g_outbox.retryMax
+	}
+	return ret
+}
+
+func run() {
+	for {
+		time.Sleep(TICK)
+		retryDue(time.Now())
+	}
+}
+
+// retryDue sends the notifications whose time has come to the workers, and
+// gives up the ones that are too old
+func retryDue(now time.Time) {
+	var due, dropped []*entry
+
+	g_outbox.Lock()
+	for id, e := range g_outbox.entries {
+		if e.sending || e.NextTry.After(now) {
+			continue
+		}
+		if now.Sub(e.Created) > g_outbox.maxAge {
+			delete(g_outbox.entries, id)
+			remove(e)
+			dropped = append(dropped, e)
+			continue
+		}
+		e.sending = true
+		due = append(due, e)
+	}
+	g_outbox.Unlock()
+
+	for _, e := range due {
+		worker.G_WorkQueue <- retryRequest{e}
+	}
+	for _, e := range dropped {
+		err := fmt.Errorf("notification given up after %d attempts", e.Attempts)
+		eslog.Error("%s : %s", os.Args[0], err.Error())
+		notifyFailure(e.notification.Origin(), true, err)
+	}
+}
+
+type retryRequest struct {
+	e *entry
+}
+
+func (r retryRequest) DoRequest() {
+	e := r.e
+	err := e.notification.Deliver()
+
+	g_outbox.Lock()
+	e.sending = false
+	if err == nil {
+		delete(g_outbox.entries, e.Id)
+		remove(e)
+	} else {
+		e.Attempts++
+		e.NextTry = time.Now().Add(getBackoff(e.Attempts))
+		if e.Payload != nil {
+			save(e)
+		}
+	}
+	onSuccess := g_outbox.onSuccess
+	g_outbox.Unlock()
+
+	if err != nil {
+		eslog.Warning("%s : notification failed again (attempt %d), %s", os.Args[0], e.Attempts, err.Error())
+		notifyFailure(e.notification.Origin(), false, err)
+	} else {
+		eslog.Info("%s : notification delivered after %d attempts", os.Args[0], e.Attempts+1)
+		if onSuccess != nil {
+			onSuccess(e.notification.Origin())
+		}
+	}
+}
+
+func notifyFailure(origin string, dropped bool, err error) {
+	g_outbox.Lock()
+	onFailure := g_outbox.onFailure
+	g_outbox.Unlock()
+	if onFailure != nil {
+		onFailure(origin, dropped, err)
+	}
+}
+
+func newId() string {
+	random := make([]byte, 6)
+	rand.Read(random)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(random)
+}
+
+/*
+** Files of the outbox. Must be called with the outbox locked.
+ */
+
+func save(e *entry) error {
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(g_outbox.path, 0700); err != nil {
+		return err
+	}
+	//write then rename, to never have half a file
+	tmp := filepath.Join(g_outbox.path, e.Id+".tmp")
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(g_outbox.path, e.Id+EXTENSION))
+}
+
+func remove(e *entry) {
+	if e.Payload != nil && g_outbox.path != "" {
+		os.Remove(filepath.Join(g_outbox.path, e.Id+EXTENSION))
+	}
+}
+
+func load() error {
+	files, err := ioutil.ReadDir(g_outbox.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), EXTENSION) {
+			continue
+		}
+		if err = loadFile(filepath.Join(g_outbox.path, f.Name())); err != nil {
+			eslog.Error("%s : failed to load %s from the outbox, %s", os.Args[0], f.Name(), err.Error())
+		}
+	}
+	if len(g_outbox.entries) > 0 {
+		eslog.Info("%s : %d notifications to send again in the outbox", os.Args[0], len(g_outbox.entries))
+	}
+	return nil
+}
+
+func loadFile(name string) error {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	e := new(entry)
+	if err = json.Unmarshal(content, e); err != nil {
+		return err
+	}
+	decode, ok := g_outbox.decoders[e.Kind]
+	if !ok {
+		return errors.New("unknown notification kind " + e.Kind)
+	}
+	if e.notification, err = decode(e.Payload); err != nil {
+		return err
+	}
+	g_outbox.entries[e.Id] = e
+	return nil
+}
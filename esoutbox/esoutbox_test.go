@@ -0,0 +1,147 @@
+package esoutbox
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeNotif struct {
+	Text   string
+	Fail   bool
+	origin string
+}
+
+func (f *fakeNotif) Deliver() error {
+	if f.Fail {
+		return errors.New("server down")
+	}
+	return nil
+}
+
+func (f *fakeNotif) Origin() string {
+	return f.origin
+}
+
+func (f *fakeNotif) Kind() string {
+	return "fake"
+}
+
+func (f *fakeNotif) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"Text": f.Text})
+}
+
+func decodeFake(data []byte) (Notification, error) {
+	f := new(fakeNotif)
+	err := json.Unmarshal(data, f)
+	return f, err
+}
+
+func initForTests(t *testing.T, path string) {
+	eslog.InitSilent()
+	config.G_Config.Config = &config.Config{}
+	config.G_Config.Config.Outbox = config.Outbox{Path: path, Max_age: "1h", Retry_min: "10s", Retry_max: "1m"}
+	Register("fake", decodeFake)
+	assert.Nil(t, Init())
+}
+
+func TestGetBackoff(t *testing.T) {
+	g_outbox.retryMin = 10 * time.Second
+	g_outbox.retryMax = time.Minute
+	assert.Equal(t, 10*time.Second, getBackoff(1))
+	assert.Equal(t, 20*time.Second, getBackoff(2))
+	assert.Equal(t, 40*time.Second, getBackoff(3))
+	assert.Equal(t, time.Minute, getBackoff(4))
+	assert.Equal(t, time.Minute, getBackoff(100))
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration("", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, d)
+	d, err = parseDuration("2m", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Minute, d)
+	_, err = parseDuration("-2m", time.Hour)
+	assert.NotNil(t, err)
+	_, err = parseDuration("soon", time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestOutbox(t *testing.T) {
+	var failures, drops []string
+
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	initForTests(t, dir)
+	SetFailureHandler(func(origin string, dropped bool, err error) {
+		if dropped {
+			drops = append(drops, origin)
+		} else {
+			failures = append(failures, origin)
+		}
+	})
+	defer SetFailureHandler(nil)
+
+	//delivered at once, nothing in the outbox
+	Deliver(&fakeNotif{Text: "ok", origin: "q1"})
+	assert.Equal(t, 0, Pending())
+	assert.Equal(t, 0, len(failures))
+
+	//failed, saved on disk
+	Deliver(&fakeNotif{Text: "alert", Fail: true, origin: "q1"})
+	assert.Equal(t, 1, Pending())
+	assert.Equal(t, []string{"q1"}, failures)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+EXTENSION))
+	assert.Equal(t, 1, len(files))
+
+	//after a restart, the notification is loaded from the disk
+	initForTests(t, dir)
+	assert.Equal(t, 1, Pending())
+	var e *entry
+	for _, v := range g_outbox.entries {
+		e = v
+	}
+	assert.Equal(t, "alert", e.notification.(*fakeNotif).Text)
+	assert.Equal(t, 1, e.Attempts)
+
+	//fails again, waits longer
+	e.notification.(*fakeNotif).Fail = true
+	retryRequest{e}.DoRequest()
+	assert.Equal(t, 2, e.Attempts)
+	assert.True(t, e.NextTry.After(time.Now().Add(15*time.Second)))
+	assert.Equal(t, 1, Pending())
+
+	//delivered, removed from the disk
+	e.notification.(*fakeNotif).Fail = false
+	retryRequest{e}.DoRequest()
+	assert.Equal(t, 0, Pending())
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+EXTENSION))
+	assert.Equal(t, 0, len(files))
+
+	//given up when too old
+	Deliver(&fakeNotif{Text: "old", Fail: true, origin: "q2"})
+	assert.Equal(t, 1, Pending())
+	retryDue(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 0, Pending())
+	assert.Equal(t, []string{"q2"}, drops)
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+EXTENSION))
+	assert.Equal(t, 0, len(files))
+}
+
+func TestOutboxInMemory(t *testing.T) {
+	initForTests(t, "")
+	Deliver(&fakeNotif{Text: "alert", Fail: true})
+	assert.Equal(t, 1, Pending())
+	for _, e := range g_outbox.entries {
+		assert.Nil(t, e.Payload)
+	}
+}
@@ -1,41 +1,133 @@
 package esslack
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eshttp"
 	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/esoutbox"
 	"github.com/amundi/escheck/worker"
+	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 const (
-	SLACKADDR = "https://slack.com/api/chat.postMessage"
+	SLACKADDR       = "https://slack.com/api/chat.postMessage"
+	SLACKUPDATEADDR = "https://slack.com/api/chat.update"
+	DEFAULT_USER    = "Elastic-Alert"
+	COLOR_ALERT     = "danger"
+	COLOR_RECOVERY  = "good"
+	//max length of the text of a block, slack refuses more than 3000
+	MAX_BLOCK_LEN = 2900
+	//max width of the cells of the tables
+	MAX_CELL_LEN = 30
+	//number of times a message is resent when slack asks us to slow down
+	MAX_RATE_RETRIES = 3
+	//used when slack sends a 429 without a valid Retry-After header
+	DEFAULT_RETRY_AFTER = 1 * time.Second
+	//name of the slack messages in the outbox
+	KIND = "slack"
 )
 
 var g_slack = struct {
-	token    string
-	client   *http.Client
-	proxyUrl *url.URL //in case you have a proxy
+	token     string
+	webhook   string //incoming webhook, used instead of the token if set
+	apiUrl    string
+	updateUrl string
+	client    *http.Client
 }{}
 
 type SlackMsg struct {
 	text    string
 	user    string
 	channel string
+	webhook string
+	color   string
+	fields  []Field
+	code    string //preformatted text, like a table
+	//threading. The thread is shared between the alert message and the
+	//end of alert message of a query
+	thread       *Thread
+	alert        *alertThread //thread of the alert, set when the message is sent
+	threadTs     string
+	endThread    bool
+	updateParent bool
+	origin       string //name of the query sending the message
+}
+
+// message saved in the outbox when it can't be delivered. The thread can't be
+// saved, so the message is posted as a reply to the timestamp it had.
+type slackState struct {
+	Text     string
+	User     string
+	Channel  string
+	Webhook  string
+	Color    string
+	Fields   []Field
+	Code     string
+	ThreadTs string
+	Origin   string
+}
+
+// Thread links the messages of the alerts of a query. Each alert gets its own
+// slack thread: the first message starts it, the next ones are posted as
+// replies to it. It only works with the Web API, webhooks don't send back the
+// timestamp of the message.
+type Thread struct {
+	current *alertThread //nil if no alert is going on
+	sync.Mutex
+}
+
+// alertThread is the slack thread of one alert. The messages keep it from the
+// moment they are sent, so the workers and the outbox post them in the right
+// thread even once the alert is over.
+type alertThread struct {
+	ts      string
+	channel string
+	text    string
+	start   time.Time
+	posting bool       //the first message is being posted
+	failed  bool       //the first message didn't start the thread
+	waiting []SlackMsg //messages posted once the first one has a timestamp
+	sync.Mutex
+}
+
+// a field displayed under the text of the message, for example the hit count
+type Field struct {
+	Title string
+	Value string
+}
+
+//response sent back by the web API. Webhooks only answer with plain text.
+type slackResponse struct {
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Ts      string `json:"ts"`
+	Channel string `json:"channel"`
 }
 
 func Init() {
 	var err error
 
 	g_slack.token = config.G_Config.Config.Token
-	g_slack.proxyUrl, err = url.Parse(getProxy())
+	g_slack.webhook = config.G_Config.Config.Webhook
+	g_slack.apiUrl = SLACKADDR
+	g_slack.updateUrl = SLACKUPDATEADDR
+	//in case you have a proxy
+	g_slack.client, err = eshttp.NewClient(config.G_Config.Config.GetSlackProxy())
 	if err != nil {
 		eslog.Error("%s : "+err.Error(), os.Args[0])
 	}
-	g_slack.client = &http.Client{
-		Transport: &http.Transport{Proxy: http.ProxyURL(g_slack.proxyUrl)},
-	}
+	esoutbox.Register(KIND, decodeSlackMsg)
 }
 
 func NewSlackMsg(text string, user string, channel string) (ret *SlackMsg) {
@@ -58,37 +150,443 @@ func (s *SlackMsg) SetChannel(channel string) {
 	s.channel = channel
 }
 
+// SetWebhook overrides the global incoming webhook for this message
+func (s *SlackMsg) SetWebhook(webhook string) {
+	s.webhook = webhook
+}
+
+// SetColor sets the color of the bar on the side of the message. Use
+// COLOR_ALERT, COLOR_RECOVERY, or any hex color like "#439FE0"
+func (s *SlackMsg) SetColor(color string) {
+	s.color = color
+}
+
+func (s *SlackMsg) AddField(title string, value string) {
+	s.fields = append(s.fields, Field{title, value})
+}
+
+func (s *SlackMsg) ResetFields() {
+	s.fields = nil
+}
+
+// SetPreformatted adds a monospace text under the message, cut if too long
+func (s *SlackMsg) SetPreformatted(code string) {
+	if len(code) > MAX_BLOCK_LEN {
+		cut := MAX_BLOCK_LEN
+		for !utf8.RuneStart(code[cut]) {
+			cut--
+		}
+		code = code[:cut] + "\n..."
+	}
+	s.code = code
+}
+
+// FormatTable displays rows of values as a text table with aligned columns, to
+// be displayed in a monospace font. The cells are cut if too long.
+func FormatTable(columns []string, rows [][]string) string {
+	var buf bytes.Buffer
+
+	widths := make([]int, len(columns))
+	lines := append([][]string{columns}, rows...)
+	for _, line := range lines {
+		for i := range columns {
+			if i < len(line) && cellLen(line[i]) > widths[i] {
+				widths[i] = cellLen(line[i])
+			}
+		}
+	}
+	for _, line := range lines {
+		for i := range columns {
+			value := ""
+			if i < len(line) {
+				value = cutCell(line[i])
+			}
+			buf.WriteString(value + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value)))
+			if i < len(columns)-1 {
+				buf.WriteString(" | ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// the characters slack wants escaped in texts
+func escape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+func cellLen(value string) int {
+	return utf8.RuneCountInString(cutCell(value))
+}
+
+func cutCell(value string) string {
+	value = strings.Replace(value, "\n", " ", -1)
+	if utf8.RuneCountInString(value) > MAX_CELL_LEN {
+		return string([]rune(value)[:MAX_CELL_LEN-1]) + "…"
+	}
+	return value
+}
+
+// SetThread makes the message part of a thread. If the thread has not started
+// yet, the message starts it, else it is posted as a reply.
+func (s *SlackMsg) SetThread(t *Thread) {
+	s.thread = t
+}
+
+// SetEndOfThread makes the message close its thread: it is posted as a reply,
+// and the next message will start a new thread. If update is true, the first
+// message of the thread is modified to show that the alert is resolved.
+func (s *SlackMsg) SetEndOfThread(update bool) {
+	s.endThread = true
+	s.updateParent = update
+}
+
+func NewThread() *Thread {
+	return new(Thread)
+}
+
+// IsStarted tells if an alert is going on, its next messages being replies
+func (t *Thread) IsStarted() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.current != nil
+}
+
+// bind gives the thread of the current alert to a message being sent. The end
+// of alert closes it right away, so the next alert starts a new thread even if
+// the end message is not delivered yet.
+func (t *Thread) bind(end bool) *alertThread {
+	t.Lock()
+	defer t.Unlock()
+	a := t.current
+	if end {
+		t.current = nil
+	} else if a == nil {
+		a = new(alertThread)
+		t.current = a
+	}
+	return a
+}
+
+func (s *SlackMsg) SetOrigin(origin string) {
+	s.origin = origin
+}
+
 func (s *SlackMsg) Send() {
-	collectorSlack(*s)
+	collectorSlack(s.bind())
 }
 
 func collectorSlack(s SlackMsg) {
 	worker.G_WorkQueue <- s
 }
 
-func (s SlackMsg) GetSlackRequest() string {
+// GetSlackPayload builds the JSON body of the message. The text is always set
+// at the top level so that notifications have something to display, and the
+// blocks are put in a colored attachment.
+func (s SlackMsg) GetSlackPayload() ([]byte, error) {
+	return json.Marshal(s.getPayload())
+}
+
+func (s SlackMsg) getPayload() map[string]interface{} {
 	if s.user == "" {
-		s.user = "Elastic-Alert"
+		s.user = DEFAULT_USER
+	}
+	payload := map[string]interface{}{
+		"username": s.user,
+		"text":     s.text,
+	}
+	if s.channel != "" {
+		payload["channel"] = s.channel
+	}
+	if s.threadTs != "" {
+		payload["thread_ts"] = s.threadTs
+	}
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": s.text},
+		},
+	}
+	if len(s.fields) > 0 {
+		fields := make([]interface{}, len(s.fields))
+		for i, f := range s.fields {
+			fields[i] = map[string]string{"type": "mrkdwn", "text": "*" + f.Title + "*\n" + f.Value}
+		}
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields})
+	}
+	if s.code != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": "```" + escape(s.code) + "```"},
+		})
 	}
-	return SLACKADDR +
-		"?username=" + url.QueryEscape(s.user) +
-		"&token=" + getSlackToken() +
-		"&channel=" + url.QueryEscape(s.channel) +
-		"&pretty=1&text=" + url.QueryEscape(s.text)
+	if s.color != "" {
+		payload["attachments"] = []interface{}{
+			map[string]interface{}{"color": s.color, "fallback": s.text, "blocks": blocks},
+		}
+	} else {
+		payload["blocks"] = blocks
+	}
+	return payload
 }
 
+// if the message can't be sent, it goes to the outbox to be sent again later
 func (s SlackMsg) DoRequest() {
-	_, err := http.Get(s.GetSlackRequest())
+	esoutbox.Deliver(s.bind())
+}
+
+// bind gives the message the thread of its alert, once. An end of alert sent
+// while no alert is going on is a simple message.
+func (s SlackMsg) bind() SlackMsg {
+	if s.thread != nil && s.alert == nil {
+		s.alert = s.thread.bind(s.endThread)
+	}
+	return s
+}
+
+func (s SlackMsg) Deliver() error {
+	var err error
+
+	if s.alert != nil {
+		err = s.sendInThread()
+	} else {
+		_, err = s.post()
+	}
 	if err != nil {
-		eslog.Error(err.Error())
+		return fmt.Errorf("error sending slack message to %s : %s", s.channel, err.Error())
 	}
+	return nil
 }
 
-func getSlackToken() string {
-	return g_slack.token
+func (s SlackMsg) Origin() string {
+	return s.origin
+}
+
+func (s SlackMsg) Kind() string {
+	return KIND
+}
+
+func (s SlackMsg) MarshalJSON() ([]byte, error) {
+	state := slackState{
+		Text:     s.text,
+		User:     s.user,
+		Channel:  s.channel,
+		Webhook:  s.webhook,
+		Color:    s.color,
+		Fields:   s.fields,
+		Code:     s.code,
+		ThreadTs: s.threadTs,
+		Origin:   s.origin,
+	}
+	if s.alert != nil && state.ThreadTs == "" {
+		s.alert.Lock()
+		state.ThreadTs = s.alert.ts
+		s.alert.Unlock()
+	}
+	return json.Marshal(state)
+}
+
+// decodeSlackMsg gives back a message saved in the outbox
+func decodeSlackMsg(data []byte) (esoutbox.Notification, error) {
+	var state slackState
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return SlackMsg{
+		text:     state.Text,
+		user:     state.User,
+		channel:  state.Channel,
+		webhook:  state.Webhook,
+		color:    state.Color,
+		fields:   state.Fields,
+		code:     state.Code,
+		threadTs: state.ThreadTs,
+		origin:   state.Origin,
+	}, nil
+}
+
+// sendInThread posts the message in the thread of its alert. The first message
+// starts the thread, the others wait for its timestamp to be posted as replies,
+// whatever the order the workers pick them in. If the thread can't be started,
+// they are posted as simple messages.
+func (s SlackMsg) sendInThread() error {
+	a := s.alert
+	a.Lock()
+	switch {
+	case a.ts != "":
+		s.threadTs = a.ts
+	case a.failed:
+	case a.posting || s.endThread:
+		//an end of alert never starts the thread, the alert is on its way
+		a.waiting = append(a.waiting, s)
+		a.Unlock()
+		return nil
+	default:
+		a.posting = true
+		a.Unlock()
+		return s.startThread()
+	}
+	a.Unlock()
+	if _, err := s.post(); err != nil {
+		return err
+	}
+	//the message is sent, so a failed update must not make it sent again
+	if s.endThread && s.threadTs != "" && s.updateParent {
+		if err := s.resolveParent(); err != nil {
+			eslog.Error("%s : error updating the first message of the thread : "+err.Error(), os.Args[0])
+		}
+	}
+	return nil
+}
+
+// startThread posts the first message of the alert, then the messages that
+// waited for it
+func (s SlackMsg) startThread() error {
+	a := s.alert
+	resp, err := s.post()
+	a.Lock()
+	a.posting = false
+	if err != nil || resp.Ts == "" {
+		a.failed = true
+	} else {
+		a.ts = resp.Ts
+		a.channel = resp.Channel
+		a.text = s.text
+		a.start = time.Now()
+	}
+	waiting := a.waiting
+	a.waiting = nil
+	a.Unlock()
+	for _, m := range waiting {
+		esoutbox.Deliver(m)
+	}
+	return err
+}
+
+// resolveParent modifies the first message of the thread to show that the
+// alert is over, and how long it lasted
+func (s SlackMsg) resolveParent() error {
+	t := s.alert
+	parent := SlackMsg{
+		text:    fmt.Sprintf("RESOLVED after %s : %s", time.Since(t.start).Truncate(time.Second), t.text),
+		user:    s.user,
+		channel: t.channel,
+		color:   COLOR_RECOVERY,
+	}
+	payload := parent.getPayload()
+	payload["ts"] = t.ts
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = s.postTo(g_slack.updateUrl, body)
+	return err
+}
+
+// post sends the message, and waits then tries again if slack says we are
+// sending too many messages
+func (s SlackMsg) post() (*slackResponse, error) {
+	body, err := s.GetSlackPayload()
+	if err != nil {
+		return nil, err
+	}
+	return s.postTo(s.getUrl(), body)
+}
+
+func (s SlackMsg) postTo(url string, body []byte) (*slackResponse, error) {
+	for i := 0; ; i++ {
+		resp, err := s.doPost(url, body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && i < MAX_RATE_RETRIES {
+			wait := getRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			eslog.Warning("%s : slack rate limit reached, retrying in %s", os.Args[0], wait)
+			time.Sleep(wait)
+			continue
+		}
+		defer resp.Body.Close()
+		return s.readResponse(resp)
+	}
+}
+
+func (s SlackMsg) doPost(url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if !s.isWebhook() {
+		req.Header.Set("Authorization", "Bearer "+getSlackToken())
+	}
+	return getClient().Do(req)
+}
+
+func (s SlackMsg) readResponse(resp *http.Response) (*slackResponse, error) {
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("slack answered %s, %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+	//webhooks simply answer "ok"
+	if s.isWebhook() {
+		return &slackResponse{Ok: true}, nil
+	}
+	ret := new(slackResponse)
+	if err = json.Unmarshal(content, ret); err != nil {
+		return nil, err
+	}
+	if !ret.Ok {
+		if ret.Error == "" {
+			return ret, errors.New("slack answered with an unknown error")
+		}
+		return ret, errors.New(ret.Error)
+	}
+	return ret, nil
+}
+
+func (s SlackMsg) isWebhook() bool {
+	return s.getWebhook() != ""
+}
+
+func (s SlackMsg) getWebhook() string {
+	if s.webhook != "" {
+		return s.webhook
+	}
+	return g_slack.webhook
+}
+
+func (s SlackMsg) getUrl() string {
+	if s.isWebhook() {
+		return s.getWebhook()
+	}
+	if g_slack.apiUrl == "" {
+		return SLACKADDR
+	}
+	return g_slack.apiUrl
 }
 
-func getProxy() string {
-	// TODO
-	return ""
+// Retry-After is a number of seconds
+func getRetryAfter(header string) time.Duration {
+	sec, err := strconv.Atoi(header)
+	if err != nil || sec < 0 {
+		return DEFAULT_RETRY_AFTER
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func getClient() *http.Client {
+	if g_slack.client == nil {
+		return http.DefaultClient
+	}
+	return g_slack.client
+}
+
+func getSlackToken() string {
+	return g_slack.token
 }
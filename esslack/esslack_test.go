@@ -1,9 +1,16 @@
 package esslack
 
 import (
+	"encoding/json"
 	"github.com/amundi/escheck/eslog"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func Test_NewSlackMsg(t *testing.T) {
@@ -14,17 +21,211 @@ func Test_NewSlackMsg(t *testing.T) {
 	assert.Equal(t, "#general", test.channel)
 }
 
-func Test_getRequest(t *testing.T) {
-	eslog.Init()
-	token := "hellongi123"
-	g_slack.token = token
-	expectedRequest := "https://slack.com/api/chat.postMessage?username=test&token=" +
-		token + "&channel=%23testchannel&pretty=1&text=Salut+les+copains+c%27est+moi"
-	p := NewSlackMsg("Salut les copains c'est moi", "test", "#testchannel")
-	assert.Equal(t, expectedRequest, p.GetSlackRequest())
+func Test_outboxState(t *testing.T) {
+	test := NewSlackMsg("alert", "Bobot", "#general")
+	test.SetColor(COLOR_ALERT)
+	test.SetWebhook("https://hooks.slack.com/services/abc")
+	test.AddField("Hits", "42")
+	test.SetPreformatted("a | b")
+	test.SetOrigin("query1")
+	test.SetThread(NewThread())
+	test.alert = &alertThread{ts: "1234.5678"}
+
+	data, err := test.MarshalJSON()
+	assert.Nil(t, err)
+	n, err := decodeSlackMsg(data)
+	assert.Nil(t, err)
+	decoded := n.(SlackMsg)
+	assert.Equal(t, "query1", decoded.Origin())
+	assert.Equal(t, KIND, decoded.Kind())
+	//the thread is lost, but the message is still a reply
+	test.threadTs = test.alert.ts
+	test.thread = nil
+	test.alert = nil
+	assert.Equal(t, test.getPayload(), decoded.getPayload())
+	assert.Equal(t, test.getWebhook(), decoded.getWebhook())
+}
+
+func Test_getPayload(t *testing.T) {
+	var payload map[string]interface{}
+
+	p := NewSlackMsg("Salut les copains c'est moi", "", "#testchannel")
+	body, err := p.GetSlackPayload()
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, "Salut les copains c'est moi", payload["text"])
+	assert.Equal(t, DEFAULT_USER, payload["username"])
+	assert.Equal(t, "#testchannel", payload["channel"])
+	assert.NotNil(t, payload["blocks"])
+	assert.Nil(t, payload["attachments"])
 
-	expectedRequest = "https://slack.com/api/chat.postMessage?username=Roberto&token=" +
-		token + "&channel=%40lolo&pretty=1&text=Les+sanglots+longs+des+violons"
 	p = NewSlackMsg("Les sanglots longs des violons", "Roberto", "@lolo")
-	assert.Equal(t, expectedRequest, p.GetSlackRequest())
+	p.SetColor(COLOR_ALERT)
+	p.AddField("Hits", "42")
+	body, err = p.GetSlackPayload()
+	assert.Nil(t, err)
+	payload = nil
+	assert.Nil(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, "Roberto", payload["username"])
+	assert.Nil(t, payload["blocks"])
+	attachments, ok := payload["attachments"].([]interface{})
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 1, len(attachments))
+	attachment := attachments[0].(map[string]interface{})
+	assert.Equal(t, COLOR_ALERT, attachment["color"])
+	blocks := attachment["blocks"].([]interface{})
+	assert.Equal(t, 2, len(blocks))
+	fields := blocks[1].(map[string]interface{})["fields"].([]interface{})
+	assert.Equal(t, "*Hits*\n42", fields[0].(map[string]interface{})["text"])
+
+	p.ResetFields()
+	assert.Equal(t, 0, len(p.fields))
+}
+
+func Test_postAPI(t *testing.T) {
+	eslog.InitSilent()
+	var auth string
+	var answer string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		assert.Equal(t, "POST", r.Method)
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Contains(t, string(body), "#general")
+		w.Write([]byte(answer))
+	}))
+	defer ts.Close()
+	g_slack.token = "hellongi123"
+	g_slack.webhook = ""
+	g_slack.apiUrl = ts.URL
+
+	answer = `{"ok":true,"channel":"C1234","ts":"1503435956.000247"}`
+	resp, err := NewSlackMsg("salut", "", "#general").post()
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer hellongi123", auth)
+	assert.Equal(t, "1503435956.000247", resp.Ts)
+
+	answer = `{"ok":false,"error":"channel_not_found"}`
+	_, err = NewSlackMsg("salut", "", "#general").post()
+	assert.NotNil(t, err)
+	assert.Equal(t, "channel_not_found", err.Error())
+}
+
+func Test_postWebhook(t *testing.T) {
+	eslog.InitSilent()
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "", r.Header.Get("Authorization"))
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("channel_not_found"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	g_slack.token = "hellongi123"
+	g_slack.webhook = ts.URL + "/hook"
+
+	_, err := NewSlackMsg("salut", "", "#general").post()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+
+	msg := NewSlackMsg("salut", "", "#general")
+	msg.SetWebhook(ts.URL + "/broken")
+	_, err = msg.post()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "channel_not_found")
+	g_slack.webhook = ""
+}
+
+func Test_thread(t *testing.T) {
+	eslog.InitSilent()
+	var received []map[string]interface{}
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		received = append(received, payload)
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{"ok":true,"channel":"C1234","ts":"1503435956.000247"}`))
+	}))
+	defer ts.Close()
+	g_slack.webhook = ""
+	g_slack.apiUrl = ts.URL + "/post"
+	g_slack.updateUrl = ts.URL + "/update"
+
+	thread := NewThread()
+	alert := NewSlackMsg("problem", "", "#general")
+	alert.SetThread(thread)
+	end := NewSlackMsg("end of problem", "", "#general")
+	end.SetThread(thread)
+	end.SetEndOfThread(true)
+
+	//first alert starts the thread
+	alert.DoRequest()
+	assert.Equal(t, true, thread.IsStarted())
+	assert.Nil(t, received[0]["thread_ts"])
+	//second is a reply
+	alert.DoRequest()
+	assert.Equal(t, "1503435956.000247", received[1]["thread_ts"])
+	//end of alert replies, then updates the first message and closes the thread
+	end.DoRequest()
+	assert.Equal(t, "1503435956.000247", received[2]["thread_ts"])
+	assert.Equal(t, []string{"/post", "/post", "/post", "/update"}, paths)
+	assert.Equal(t, "1503435956.000247", received[3]["ts"])
+	assert.Equal(t, "C1234", received[3]["channel"])
+	assert.Contains(t, received[3]["text"], "RESOLVED after")
+	assert.Equal(t, false, thread.IsStarted())
+
+	//end of alert without thread is a simple message
+	end.DoRequest()
+	assert.Nil(t, received[4]["thread_ts"])
+	assert.Equal(t, 5, len(received))
+
+	//the end of alert picked before the alert waits for the thread to start
+	first := alert.bind()
+	last := end.bind()
+	assert.Equal(t, false, thread.IsStarted())
+	last.DoRequest()
+	assert.Equal(t, 5, len(received))
+	//the next alert doesn't reply in the closed thread
+	next := alert.bind()
+	first.DoRequest()
+	assert.Nil(t, received[5]["thread_ts"])
+	assert.Equal(t, "1503435956.000247", received[6]["thread_ts"])
+	assert.Equal(t, "/update", paths[7])
+	next.DoRequest()
+	assert.Nil(t, received[8]["thread_ts"])
+	assert.Equal(t, 9, len(received))
+}
+
+func Test_FormatTable(t *testing.T) {
+	table := FormatTable([]string{"host", "status"}, [][]string{
+		{"srv1", "500"},
+		{"a-very-long-host-name-that-will-be-cut", "404"},
+	})
+	assert.Equal(t, "host                           | status\n"+
+		"srv1                           | 500   \n"+
+		"a-very-long-host-name-that-wi… | 404   ", table)
+
+	p := NewSlackMsg("problem", "", "#general")
+	p.SetPreformatted("a < b")
+	body, err := p.GetSlackPayload()
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "```a \\u0026lt; b```")
+	p.SetPreformatted(strings.Repeat("é", MAX_BLOCK_LEN))
+	assert.Equal(t, true, utf8.ValidString(p.code))
+}
+
+func Test_getRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, getRetryAfter("30"))
+	assert.Equal(t, DEFAULT_RETRY_AFTER, getRetryAfter(""))
+	assert.Equal(t, DEFAULT_RETRY_AFTER, getRetryAfter("soon"))
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eshttp"
+	"github.com/amundi/escheck/eslog"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+** Dead man's switch: while every query loop is working, eschecker regularly
+** calls an url and/or writes the time in a file. An external watchdog can then
+** alert if the calls stop, because eschecker died or a query is stuck.
+ */
+
+const (
+	DEFAULT_HEARTBEAT_EVERY = 1 * time.Minute
+	DEFAULT_HEARTBEAT_GRACE = 1 * time.Minute
+	HEARTBEAT_TIMEOUT       = 10 * time.Second
+)
+
+var g_heartbeat = struct {
+	url    string
+	file   string
+	every  time.Duration
+	grace  time.Duration //extra time given to a query to complete a cycle
+	client *http.Client
+	//time before which each query must have completed its next cycle
+	deadlines map[string]time.Time
+	sync.Mutex
+}{deadlines: make(map[string]time.Time)}
+
+func isHeartbeat() bool {
+	return g_heartbeat.url != "" || g_heartbeat.file != ""
+}
+
+func initHeartbeat() error {
+	var err error
+
+	info := config.G_Config.Config.Heartbeat
+	g_heartbeat.url = info.Url
+	g_heartbeat.file = info.File
+	g_heartbeat.every = DEFAULT_HEARTBEAT_EVERY
+	g_heartbeat.grace = DEFAULT_HEARTBEAT_GRACE
+	if info.Every != "" {
+		if g_heartbeat.every, err = time.ParseDuration(info.Every); err != nil || g_heartbeat.every <= 0 {
+			return errors.New("invalid heartbeat every " + info.Every)
+		}
+	}
+	if info.Grace != "" {
+		if g_heartbeat.grace, err = time.ParseDuration(info.Grace); err != nil || g_heartbeat.grace < 0 {
+			return errors.New("invalid heartbeat grace " + info.Grace)
+		}
+	}
+	if g_heartbeat.url != "" {
+		if g_heartbeat.client, err = eshttp.NewClient(""); err != nil {
+			return err
+		}
+		g_heartbeat.client.Timeout = HEARTBEAT_TIMEOUT
+	}
+	//the queries must start before the first beats, so that a query hanging
+	//before its loop is seen as stuck. The ones failing to start are forgotten.
+	g_heartbeat.Lock()
+	defer g_heartbeat.Unlock()
+	g_heartbeat.deadlines = make(map[string]time.Time)
+	start := time.Now().Add(g_heartbeat.every + g_heartbeat.grace)
+	for name := range g_queryList {
+		g_heartbeat.deadlines[name] = start
+	}
+	return nil
+}
+
+// heartbeatBeat is called by a query loop at the end of a cycle. next is the
+// longest time the next cycle can take: the wait and the timeout of the request.
+func heartbeatBeat(name string, next time.Duration) {
+	g_heartbeat.Lock()
+	defer g_heartbeat.Unlock()
+	g_heartbeat.deadlines[name] = time.Now().Add(next + g_heartbeat.grace)
+}
+
+// heartbeatForget stops watching a query, until its next beat
+func heartbeatForget(name string) {
+	g_heartbeat.Lock()
+	defer g_heartbeat.Unlock()
+	delete(g_heartbeat.deadlines, name)
+}
+
+// getStuckQueries gives the queries late for their next cycle
+func getStuckQueries(now time.Time) []string {
+	var ret []string
+
+	g_heartbeat.Lock()
+	defer g_heartbeat.Unlock()
+	for name, deadline := range g_heartbeat.deadlines {
+		if now.After(deadline) {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func runHeartbeat() {
+	for {
+		time.Sleep(g_heartbeat.every)
+		if err := beat(time.Now()); err != nil {
+			eslog.Error("%s : heartbeat : %s", os.Args[0], err.Error())
+		}
+	}
+}
+
+// beat calls the url and writes the file, if no query is stuck
+func beat(now time.Time) error {
+	if stuck := getStuckQueries(now); len(stuck) > 0 {
+		return fmt.Errorf("not sent, queries stuck : %s", strings.Join(stuck, ", "))
+	}
+	if g_heartbeat.file != "" {
+		if err := writeHeartbeatFile(now); err != nil {
+			return err
+		}
+	}
+	if g_heartbeat.url != "" {
+		resp, err := g_heartbeat.client.Get(g_heartbeat.url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s answered %s", g_heartbeat.url, resp.Status)
+		}
+	}
+	return nil
+}
+
+// write then rename, so that the watchdog never reads half a file
+func writeHeartbeatFile(now time.Time) error {
+	tmp := g_heartbeat.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(now.Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g_heartbeat.file)
+}
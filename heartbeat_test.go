@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/queries"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Heartbeat(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "heartbeat")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "heartbeat")
+
+	saved := g_queryList
+	defer func() { g_queryList = saved }()
+	g_queryList = map[string]queries.Query{}
+	config.G_Config.Config = &config.Config{}
+	config.G_Config.Config.Heartbeat = config.Heartbeat{Url: ts.URL, File: file, Grace: "10s"}
+	assert.Nil(t, initHeartbeat())
+	assert.True(t, isHeartbeat())
+	assert.Equal(t, DEFAULT_HEARTBEAT_EVERY, g_heartbeat.every)
+	defer func() { g_heartbeat.deadlines = make(map[string]time.Time) }()
+
+	//every query is on time
+	heartbeatBeat("q1", time.Minute)
+	heartbeatBeat("q2", time.Hour)
+	now := time.Now()
+	assert.Nil(t, beat(now))
+	assert.Equal(t, 1, calls)
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Format(time.RFC3339)+"\n", string(content))
+
+	//q1 is late
+	err = beat(now.Add(2 * time.Minute))
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "q1"))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, []string{"q1"}, getStuckQueries(now.Add(2*time.Minute)))
+	assert.Equal(t, []string{"q1", "q2"}, getStuckQueries(now.Add(2*time.Hour)))
+
+	//the grace is given to the queries
+	assert.Nil(t, getStuckQueries(now.Add(time.Minute+5*time.Second)))
+
+	//a query of the list that never starts its loop
+	g_queryList = map[string]queries.Query{"q3": new(autoQuery)}
+	assert.Nil(t, initHeartbeat())
+	now = time.Now()
+	assert.Nil(t, getStuckQueries(now))
+	assert.Equal(t, []string{"q3"}, getStuckQueries(now.Add(DEFAULT_HEARTBEAT_EVERY+time.Minute)))
+	heartbeatBeat("q3", time.Hour)
+	assert.Nil(t, getStuckQueries(now.Add(DEFAULT_HEARTBEAT_EVERY+time.Minute)))
+
+	config.G_Config.Config.Heartbeat = config.Heartbeat{File: file, Every: "pouet"}
+	assert.NotNil(t, initHeartbeat())
+}
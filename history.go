@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/queries"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+** History of the alerts of each query: when they started and ended, their hits
+** and the notifications sent. The last history_size events of each query are
+** kept, and saved in history_file every few seconds so that they survive a
+** restart. The outbox
+** tells which notifications failed, they are given to the last event of the
+** query that sent some.
+ */
+
+const (
+	//events kept by query, unless history_size is given
+	HISTORY_SIZE = 50
+	//how often the changes are written in the file
+	HISTORY_FLUSH_EVERY = 10 * time.Second
+	EVENT_START         = "start"
+	EVENT_END           = "end"
+	//nothing was sent: the query is muted, or has no end message
+	DELIVERY_NONE = "none"
+	//no failure reported by the outbox
+	DELIVERY_SENT     = "sent"
+	DELIVERY_RETRYING = "retrying"
+	//delivered after failing
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_DROPPED   = "dropped"
+)
+
+type alertEvent struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	AlertId string    `json:"alert_id"`
+	Hits    int64     `json:"hits"`
+	//notifications of the alert, repeated ones included. Only on the start.
+	Notifications int `json:"notifications,omitempty"`
+	//duration of the alert, and who acknowledged it. Only on the end.
+	Duration string   `json:"duration,omitempty"`
+	AckBy    string   `json:"ack_by,omitempty"`
+	Actions  []string `json:"actions"`
+	Muted    bool     `json:"muted,omitempty"`
+	Delivery string   `json:"delivery"`
+}
+
+var g_history = struct {
+	file string
+	size int
+	list map[string][]alertEvent //the oldest first
+	//changed since the last write of the file
+	dirty bool
+	sync.Mutex
+}{size: HISTORY_SIZE, list: make(map[string][]alertEvent)}
+
+//only one write of the file at a time
+var g_historySave sync.Mutex
+
+// initHistory reads the config, and the history saved before the restart
+func initHistory() error {
+	var list map[string][]alertEvent
+
+	g_history.Lock()
+	defer g_history.Unlock()
+	g_history.file = config.G_Config.Config.History_file
+	g_history.size = HISTORY_SIZE
+	if size := config.G_Config.Config.History_size; size > 0 {
+		g_history.size = size
+	}
+	g_history.list = make(map[string][]alertEvent)
+	g_history.dirty = false
+	if g_history.file == "" {
+		return nil
+	}
+	source, err := ioutil.ReadFile(g_history.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(source, &list); err != nil {
+		return err
+	}
+	for name, events := range list {
+		if len(events) > g_history.size {
+			events = events[len(events)-g_history.size:]
+		}
+		g_history.list[name] = events
+	}
+	return nil
+}
+
+// getActionNames gives the actions and receivers notified by a query
+func getActionNames(c queries.Query) []string {
+	if a, ok := c.(*autoQuery); ok {
+		var ret []string
+		if a.digest != nil {
+			ret = []string{"digest"}
+		} else {
+			ret = append(ret, a.actionList...)
+		}
+		//the receivers of its route
+		for _, r := range a.receivers {
+			ret = append(ret, r.receiver)
+		}
+		return ret
+	}
+	return []string{"manual"}
+}
+
+func newAlertEvent(kind string, id string, hits int64, actions []string, muted bool) alertEvent {
+	e := alertEvent{Type: kind, Time: time.Now(), AlertId: id, Hits: hits, Muted: muted, Delivery: DELIVERY_NONE}
+	if !muted && len(actions) > 0 {
+		e.Actions = actions
+		e.Delivery = DELIVERY_SENT
+	}
+	if e.Actions == nil {
+		e.Actions = []string{}
+	}
+	return e
+}
+
+// historyStart adds the start of an alert, and its first notification
+func historyStart(name string, id string, hits int64, actions []string, muted bool) {
+	e := newAlertEvent(EVENT_START, id, hits, actions, muted)
+	if !muted {
+		e.Notifications = 1
+	}
+	addEvent(name, e)
+}
+
+// historyRepeat counts a repeated notification of the current alert. The
+// delivery is the one of its last notification.
+func historyRepeat(name string) {
+	g_history.Lock()
+	defer g_history.Unlock()
+	events := g_history.list[name]
+	for i := len(events) - 1; i >= 0; i-- {
+		//the escalations happen during the alert
+		if events[i].Type == EVENT_ESCALATION {
+			continue
+		}
+		if events[i].Type == EVENT_START {
+			events[i].Notifications++
+			events[i].Delivery = DELIVERY_SENT
+			g_history.dirty = true
+		}
+		return
+	}
+}
+
+// historyEnd adds the end of an alert, with its duration. actions is empty if
+// no end message is sent.
+func historyEnd(name string, ack alertAck, hits int64, actions []string, muted bool) {
+	e := newAlertEvent(EVENT_END, ack.id, hits, actions, muted)
+	if ack.acked {
+		e.AckBy = ack.by
+	}
+	g_history.Lock()
+	if start := findStart(name, ack.id); start != nil {
+		e.Duration = e.Time.Sub(start.Time).Truncate(time.Second).String()
+	}
+	g_history.Unlock()
+	addEvent(name, e)
+}
+
+// findStart gives the start of an alert, if it is still in the history.
+// g_history must be locked.
+func findStart(name string, id string) *alertEvent {
+	events := g_history.list[name]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == EVENT_START && events[i].AlertId == id {
+			return &events[i]
+		}
+	}
+	return nil
+}
+
+func addEvent(name string, e alertEvent) {
+	g_history.Lock()
+	defer g_history.Unlock()
+	events := append(g_history.list[name], e)
+	if len(events) > g_history.size {
+		events = append([]alertEvent(nil), events[len(events)-g_history.size:]...)
+	}
+	g_history.list[name] = events
+	g_history.dirty = true
+}
+
+// historyDelivery gives the result of a delivery to the last event of the
+// query that notified. Called by the outbox, through the workers.
+func historyDelivery(name string, state string) {
+	g_history.Lock()
+	defer g_history.Unlock()
+	events := g_history.list[name]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Delivery == DELIVERY_NONE {
+			continue
+		}
+		//a notification given up stays given up
+		if events[i].Delivery != DELIVERY_DROPPED &&
+			(state != DELIVERY_DELIVERED || events[i].Delivery == DELIVERY_RETRYING) {
+			events[i].Delivery = state
+			g_history.dirty = true
+		}
+		return
+	}
+}
+
+// historyDeliverySuccess is called by the outbox when a notification is
+// delivered after failing
+func historyDeliverySuccess(origin string) {
+	historyDelivery(origin, DELIVERY_DELIVERED)
+}
+
+// getHistory gives the events of a query, the latest first
+func getHistory(name string) []alertEvent {
+	g_history.Lock()
+	defer g_history.Unlock()
+	events := g_history.list[name]
+	ret := make([]alertEvent, len(events))
+	for i, e := range events {
+		ret[len(events)-1-i] = e
+	}
+	return ret
+}
+
+func deleteHistory(name string) {
+	g_history.Lock()
+	defer g_history.Unlock()
+	delete(g_history.list, name)
+	g_history.dirty = true
+}
+
+func runHistory() {
+	for {
+		time.Sleep(HISTORY_FLUSH_EVERY)
+		saveHistory()
+	}
+}
+
+// saveHistory writes the history if it changed, then renames it so that the
+// file is never half written. The file is written without the lock, not to
+// block the queries, and marked changed again if the write fails.
+func saveHistory() {
+	g_historySave.Lock()
+	defer g_historySave.Unlock()
+	g_history.Lock()
+	if g_history.file == "" || !g_history.dirty {
+		g_history.Unlock()
+		return
+	}
+	file := g_history.file
+	content, err := json.Marshal(g_history.list)
+	g_history.dirty = false
+	g_history.Unlock()
+
+	if err == nil {
+		tmp := file + ".tmp"
+		if err = ioutil.WriteFile(tmp, content, 0600); err == nil {
+			err = os.Rename(tmp, file)
+		}
+	}
+	if err != nil {
+		g_history.Lock()
+		g_history.dirty = true
+		g_history.Unlock()
+		eslog.Error("%s : failed to save the history, %s", os.Args[0], err.Error())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func initHistoryForTests(t *testing.T, file string, size int) {
+	eslog.InitSilent()
+	config.G_Config.Config = &config.Config{History_file: file, History_size: size}
+	assert.Nil(t, initHistory())
+}
+
+func Test_History(t *testing.T) {
+	initHistoryForTests(t, "", 0)
+	assert.Equal(t, HISTORY_SIZE, g_history.size)
+	assert.Equal(t, 0, len(getHistory("q1")))
+
+	//an alert notified twice, acknowledged, then ended with a message
+	id := startAlert("q1")
+	historyStart("q1", id, 12, []string{"email", "slack"}, false)
+	historyRepeat("q1")
+	ackAlert(id, "alice")
+	g_history.list["q1"][0].Time = time.Now().Add(-90 * time.Second)
+	ack, ok := endAlert("q1")
+	assert.True(t, ok)
+	historyEnd("q1", ack, 0, []string{"email", "slack"}, false)
+	events := getHistory("q1")
+	assert.Equal(t, 2, len(events))
+	//the latest first
+	assert.Equal(t, EVENT_END, events[0].Type)
+	assert.Equal(t, id, events[0].AlertId)
+	assert.Equal(t, "1m30s", events[0].Duration)
+	assert.Equal(t, "alice", events[0].AckBy)
+	assert.Equal(t, EVENT_START, events[1].Type)
+	assert.Equal(t, int64(12), events[1].Hits)
+	assert.Equal(t, 2, events[1].Notifications)
+	assert.Equal(t, []string{"email", "slack"}, events[1].Actions)
+	assert.Equal(t, DELIVERY_SENT, events[1].Delivery)
+
+	//nothing sent for a muted alert, or an end without message
+	historyStart("q2", "a", 3, []string{"email"}, true)
+	historyEnd("q2", alertAck{id: "a"}, 0, nil, false)
+	events = getHistory("q2")
+	assert.Equal(t, DELIVERY_NONE, events[0].Delivery)
+	assert.Equal(t, []string{}, events[0].Actions)
+	assert.True(t, events[1].Muted)
+	assert.Equal(t, 0, events[1].Notifications)
+	assert.Equal(t, DELIVERY_NONE, events[1].Delivery)
+	_, ok = endAlert("q2")
+	assert.False(t, ok)
+
+	deleteHistory("q1")
+	assert.Equal(t, 0, len(getHistory("q1")))
+}
+
+func Test_HistoryDelivery(t *testing.T) {
+	initHistoryForTests(t, "", 0)
+
+	historyStart("q1", "a", 3, []string{"email"}, false)
+	historyEnd("q1", alertAck{id: "a"}, 0, nil, false)
+	//given to the last event that sent something
+	historyDelivery("q1", DELIVERY_RETRYING)
+	assert.Equal(t, DELIVERY_RETRYING, getHistory("q1")[1].Delivery)
+	historyDeliverySuccess("q1")
+	assert.Equal(t, DELIVERY_DELIVERED, getHistory("q1")[1].Delivery)
+	//a success without failure changes nothing
+	historyStart("q1", "b", 3, []string{"email"}, false)
+	historyDeliverySuccess("q1")
+	assert.Equal(t, DELIVERY_SENT, getHistory("q1")[0].Delivery)
+	historyDelivery("q1", DELIVERY_DROPPED)
+	historyDeliverySuccess("q1")
+	historyDelivery("q1", DELIVERY_RETRYING)
+	assert.Equal(t, DELIVERY_DROPPED, getHistory("q1")[0].Delivery)
+	//unknown queries are ignored
+	historyDelivery("unknown", DELIVERY_DROPPED)
+	assert.Equal(t, 0, len(getHistory("unknown")))
+
+	//the outbox failures go through the stats
+	stats.statsMap = map[string]queryStats{"q2": {}}
+	historyStart("q2", "c", 3, []string{"slack"}, false)
+	deliveryFailureRequest{"q2", false}.DoRequest()
+	assert.Equal(t, DELIVERY_RETRYING, getHistory("q2")[0].Delivery)
+	assert.Equal(t, 1, stats.statsMap["q2"].DeliveryFailures)
+}
+
+func Test_HistoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.json")
+
+	//bounded to the last events
+	initHistoryForTests(t, file, 3)
+	for _, id := range []string{"a", "b"} {
+		historyStart("q1", id, 1, []string{"email"}, false)
+		historyEnd("q1", alertAck{id: id}, 0, []string{"email"}, false)
+	}
+	events := getHistory("q1")
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "a", events[2].AlertId)
+	assert.Equal(t, EVENT_END, events[2].Type)
+	//written by the flush, only once changed
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	saveHistory()
+	_, err = os.Stat(file)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(file))
+	saveHistory()
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	historyStart("q2", "c", 1, []string{"email"}, false)
+	saveHistory()
+	_, err = os.Stat(file)
+	assert.Nil(t, err)
+
+	//read again after a restart, even with a smaller size
+	initHistoryForTests(t, file, 2)
+	loaded := getHistory("q1")
+	assert.Equal(t, 2, len(loaded))
+	assert.Equal(t, "b", loaded[1].AlertId)
+	assert.True(t, loaded[1].Time.Equal(events[1].Time))
+	_, err = os.Stat(file + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	//a missing file is an empty history, a wrong one an error
+	initHistoryForTests(t, filepath.Join(dir, "missing.json"), 0)
+	assert.Equal(t, 0, len(getHistory("q1")))
+	//a failed write is tried again by the next flush
+	g_history.file = filepath.Join(dir, "nodir", "history.json")
+	historyStart("q1", "d", 1, []string{"email"}, false)
+	saveHistory()
+	assert.True(t, g_history.dirty)
+	assert.Nil(t, ioutil.WriteFile(file, []byte("{wrong"), 0600))
+	config.G_Config.Config = &config.Config{History_file: file}
+	assert.NotNil(t, initHistory())
+}
+
+func Test_GetActionNames(t *testing.T) {
+	a := &autoQuery{name: "q1", actionList: []string{"email", "slack"}}
+	assert.Equal(t, []string{"email", "slack"}, getActionNames(a))
+	a.digest = new(digest)
+	assert.Equal(t, []string{"digest"}, getActionNames(a))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/esoutbox"
+	"github.com/amundi/escheck/worker"
+	"gopkg.in/olivere/elastic.v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+** The index action writes a document in an index of the cluster each time an
+** alert is notified: its start, its repeats and its end. It gives an audit trail
+** of the alerts, searchable in kibana. The documents go through the outbox, so
+** they are written later if the cluster doesn't answer.
+ */
+
+const (
+	INDEX_KIND = "index"
+	//YYYY, MM and DD are replaced by the date of the event
+	INDEX_DEFAULT_NAME = "escheck-alerts-YYYY.MM"
+	INDEX_DEFAULT_TYPE = "alert"
+	INDEX_TIMEOUT      = 10 * time.Second
+	//ids of the documents found written in the event
+	INDEX_SAMPLE_SIZE = 10
+	INDEX_START       = "start"
+	INDEX_REPEAT      = "repeat"
+	INDEX_END         = "end"
+	MODE_DIRECT       = "direct"
+	MODE_DIGEST       = "digest"
+)
+
+type indexer struct {
+	name    string
+	docType string
+	//the alert of the last event, and when it started
+	alertId string
+	start   time.Time
+}
+
+type alertDocument struct {
+	Timestamp string       `json:"@timestamp"`
+	Query     string       `json:"query"`
+	Severity  string       `json:"severity"`
+	Event     string       `json:"event"`
+	AlertId   string       `json:"alert_id"`
+	Hits      int64        `json:"hits"`
+	Doc_ids   []string     `json:"doc_ids,omitempty"`
+	Duration  float64      `json:"duration_seconds,omitempty"` //on the end
+	Actions   []actionMode `json:"actions"`
+}
+
+// how the other actions of the query notify the event: at once, or in the
+// digest. Their delivery is in the history.
+type actionMode struct {
+	Action string `json:"action"`
+	Mode   string `json:"mode"`
+}
+
+// indexDocument is the notification writing a document in the cluster
+type indexDocument struct {
+	Path string
+	Doc  alertDocument
+}
+
+//the cluster where the documents are written, known once connected
+var g_indexCluster = struct {
+	c *cluster
+	sync.Mutex
+}{}
+
+func initIndex() {
+	esoutbox.Register(INDEX_KIND, decodeIndexDocument)
+}
+
+func setIndexCluster(c *cluster) {
+	g_indexCluster.Lock()
+	defer g_indexCluster.Unlock()
+	g_indexCluster.c = c
+}
+
+func getIndexCluster() *cluster {
+	g_indexCluster.Lock()
+	defer g_indexCluster.Unlock()
+	return g_indexCluster.c
+}
+
+func newIndexer(info config.Index) (*indexer, error) {
+	ret := &indexer{name: info.Name, docType: info.Type}
+	if ret.name == "" {
+		ret.name = INDEX_DEFAULT_NAME
+	}
+	if ret.docType == "" {
+		ret.docType = INDEX_DEFAULT_TYPE
+	}
+	if name := ret.getIndex(time.Now()); name != strings.ToLower(name) || strings.ContainsAny(name, "/ ,") {
+		return nil, fmt.Errorf("wrong index name %s, it must be in lower case", info.Name)
+	}
+	return ret, nil
+}
+
+// getIndex gives the name of the index at the date
+func (i *indexer) getIndex(date time.Time) string {
+	date = date.UTC()
+	return strings.NewReplacer("YYYY", date.Format("2006"), "MM", date.Format("01"), "DD", date.Format("02")).Replace(i.name)
+}
+
+// write sends the document of an event of the alert id to the workers
+func (i *indexer) write(a *autoQuery, event string, id string, search *elastic.SearchResult) {
+	now := time.Now()
+	doc := alertDocument{
+		Timestamp: now.UTC().Format(time.RFC3339),
+		Query:     a.name,
+		Severity:  a.severity,
+		Event:     event,
+		AlertId:   id,
+		Actions:   a.getActionModes(),
+	}
+	if search != nil && search.Hits != nil {
+		doc.Hits = search.Hits.TotalHits
+		for _, hit := range search.Hits.Hits {
+			if len(doc.Doc_ids) == INDEX_SAMPLE_SIZE {
+				break
+			}
+			doc.Doc_ids = append(doc.Doc_ids, hit.Id)
+		}
+	}
+	if event == INDEX_START {
+		i.alertId, i.start = id, now
+	} else if event == INDEX_END && i.alertId == id && !i.start.IsZero() {
+		doc.Duration = now.Sub(i.start).Truncate(time.Second).Seconds()
+	}
+	worker.G_WorkQueue <- indexDocument{"/" + i.getIndex(now) + "/" + i.docType, doc}
+}
+
+// writeAlert writes the start of an alert, or its repeat
+func (i *indexer) writeAlert(a *autoQuery, search *elastic.SearchResult) {
+	if a.alertId != i.alertId {
+		i.write(a, INDEX_START, a.alertId, search)
+	} else {
+		i.write(a, INDEX_REPEAT, a.alertId, search)
+	}
+}
+
+// getActionModes tells how the other actions and the receivers notify: at
+// once, or in the digest
+func (a *autoQuery) getActionModes() []actionMode {
+	ret := []actionMode{}
+	for _, action := range a.actionList {
+		switch {
+		case action == "index":
+			continue
+		case a.digest != nil:
+			ret = append(ret, actionMode{action, MODE_DIGEST})
+		default:
+			ret = append(ret, actionMode{action, MODE_DIRECT})
+		}
+	}
+	for _, r := range a.receivers {
+		if r.digest != nil {
+			ret = append(ret, actionMode{r.receiver, MODE_DIGEST})
+		} else {
+			ret = append(ret, actionMode{r.receiver, MODE_DIRECT})
+		}
+	}
+	return ret
+}
+
+// if the document can't be written, it goes to the outbox to be written later
+func (d indexDocument) DoRequest() {
+	esoutbox.Deliver(d)
+}
+
+func (d indexDocument) Deliver() error {
+	c := getIndexCluster()
+	if c == nil {
+		return errors.New("error writing the alert, not connected to the cluster")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), INDEX_TIMEOUT)
+	defer cancel()
+	if _, err := c.performRequest(ctx, "POST", d.Path, nil, d.Doc); err != nil {
+		return fmt.Errorf("error writing the alert in %s : %s", d.Path, err.Error())
+	}
+	return nil
+}
+
+func (d indexDocument) Origin() string {
+	return d.Doc.Query
+}
+
+func (d indexDocument) Kind() string {
+	return INDEX_KIND
+}
+
+func (d indexDocument) MarshalJSON() ([]byte, error) {
+	type state indexDocument //without the methods, not to call MarshalJSON again
+	return json.Marshal(state(d))
+}
+
+func decodeIndexDocument(data []byte) (esoutbox.Notification, error) {
+	var d indexDocument
+
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
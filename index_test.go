@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/worker"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_NewIndexer(t *testing.T) {
+	i, err := newIndexer(config.Index{})
+	assert.Nil(t, err)
+	assert.Equal(t, INDEX_DEFAULT_NAME, i.name)
+	assert.Equal(t, INDEX_DEFAULT_TYPE, i.docType)
+	date := time.Date(2026, 3, 7, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, "escheck-alerts-2026.03", i.getIndex(date))
+
+	i, err = newIndexer(config.Index{Name: "alerts-YYYY-MM-DD", Type: "_doc"})
+	assert.Nil(t, err)
+	assert.Equal(t, "alerts-2026-03-07", i.getIndex(date))
+	assert.Equal(t, "_doc", i.docType)
+
+	_, err = newIndexer(config.Index{Name: "Alerts"})
+	assert.NotNil(t, err)
+	_, err = newIndexer(config.Index{Name: "alerts/x"})
+	assert.NotNil(t, err)
+}
+
+func Test_IndexAction(t *testing.T) {
+	var search elastic.SearchResult
+
+	eslog.InitSilent()
+	paths := make(chan string, 10)
+	docs := make(chan alertDocument, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var doc alertDocument
+
+		content, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(content, &doc)
+		paths <- r.Method + " " + r.URL.Path
+		docs <- doc
+		w.Write([]byte(`{"created":true}`))
+	}))
+	defer ts.Close()
+	config.G_Config.Config = &config.Config{Cluster_addr: ts.URL}
+	c, err := newCluster(nil)
+	assert.Nil(t, err)
+	setIndexCluster(c)
+	defer setIndexCluster(nil)
+	worker.StartDispatcher(4)
+	defer worker.StopAllWorkers(4)
+
+	a := &autoQuery{name: "errors", actionList: []string{"slack", "index"}}
+	a.index, err = newIndexer(config.Index{Name: "alerts"})
+	assert.Nil(t, err)
+	json.Unmarshal([]byte(`{"hits":{"total":42,"hits":[{"_id":"a1"},{"_id":"a2"}]}}`), &search)
+
+	//the start, then the repeats of the same alert
+	a.alertId = "42"
+	a.index.writeAlert(a, &search)
+	assert.Equal(t, "POST /alerts/alert", <-paths)
+	doc := <-docs
+	assert.Equal(t, "errors", doc.Query)
+	assert.Equal(t, INDEX_START, doc.Event)
+	assert.Equal(t, "42", doc.AlertId)
+	assert.Equal(t, int64(42), doc.Hits)
+	assert.Equal(t, []string{"a1", "a2"}, doc.Doc_ids)
+	assert.Equal(t, []actionMode{{"slack", MODE_DIRECT}}, doc.Actions)
+	a.index.writeAlert(a, &search)
+	<-paths
+	assert.Equal(t, INDEX_REPEAT, (<-docs).Event)
+
+	//the end, with the duration of the alert, even without end message
+	a.index.start = time.Now().Add(-time.Minute)
+	a.recordEnd()
+	<-paths
+	doc = <-docs
+	assert.Equal(t, INDEX_END, doc.Event)
+	assert.Equal(t, float64(60), doc.Duration)
+	assert.Equal(t, int64(0), doc.Hits)
+
+	//in digest mode, the other actions are kept for the summary
+	a.digest = new(digest)
+	assert.Equal(t, []actionMode{{"slack", MODE_DIGEST}}, a.getActionModes())
+}
+
+func Test_IndexDocument(t *testing.T) {
+	d := indexDocument{"/alerts/alert", alertDocument{Query: "errors", Event: INDEX_START, Actions: []actionMode{}}}
+	assert.Equal(t, "errors", d.Origin())
+	assert.Equal(t, INDEX_KIND, d.Kind())
+
+	//saved in the outbox and read again
+	content, err := d.MarshalJSON()
+	assert.Nil(t, err)
+	decoded, err := decodeIndexDocument(content)
+	assert.Nil(t, err)
+	assert.Equal(t, d, decoded)
+
+	//not connected, or refused by the cluster
+	setIndexCluster(nil)
+	assert.NotNil(t, d.Deliver())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"IndexClosedException"}`, http.StatusForbidden)
+	}))
+	defer ts.Close()
+	config.G_Config.Config = &config.Config{Cluster_addr: ts.URL}
+	c, err := newCluster(nil)
+	assert.Nil(t, err)
+	setIndexCluster(c)
+	defer setIndexCluster(nil)
+	assert.NotNil(t, d.Deliver())
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eshttp"
 	"github.com/amundi/escheck/eslog"
 	"github.com/amundi/escheck/esmail"
+	"github.com/amundi/escheck/esoutbox"
 	"github.com/amundi/escheck/esslack"
 	"github.com/amundi/escheck/queries"
 	"github.com/amundi/escheck/worker"
@@ -14,7 +19,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -33,8 +40,7 @@ type Env struct {
 	flagcheck  *bool
 	filename   *string
 	queries    map[string]config.Query
-	client     *elastic.Client
-	semaphore  chan struct{}
+	cluster    *cluster //limits and groups the requests to the cluster
 }
 
 func main() {
@@ -43,9 +49,6 @@ func main() {
 	env.getFlags()
 	env.getConfig()
 
-	//semaphore to queue SendRequest, or else timeout gets wrong
-	env.semaphore = make(chan struct{}, 1)
-
 	//init log, if silent, nothing will be printed on stdout
 	if *env.flagsilent {
 		eslog.InitSilent()
@@ -59,18 +62,48 @@ func main() {
 	//init slack, mail etc.
 	env.initIntegrations()
 
+	//add the queries created by the API to the ones of the yaml
+	if err := env.loadRules(); err != nil {
+		eslog.Error("%s : failed to load the rules file, %s", os.Args[0], err.Error())
+	}
+
 	//get queries from yaml, if flag -c activated check them and exit
 	env.parseQueries()
+	for _, err := range checkRouting() {
+		eslog.Error("%s : routing, %s", os.Args[0], err.Error())
+	}
 
 	//init the stats for every queries and the dispatcher for workers
 	initStats()
+	if err := initHistory(); err != nil {
+		eslog.Error("%s : failed to load the history, %s", os.Args[0], err.Error())
+	}
+	go runHistory()
+	go waitShutdown()
 	worker.StartDispatcher(getNbWorkers())
 
-	//connect to the elasticsearch cluster via env.client
+	//report the problems of eschecker itself
+	initAdmin()
+
+	//send again the notifications that failed, even before a restart
+	env.initOutbox()
+
+	//connect to the elasticsearch cluster via env.cluster
 	env.connect()
+	setIndexCluster(env.cluster)
+	if isAdmin() {
+		go watchCluster(env.cluster)
+	}
+
+	//tell an external watchdog that everything works
+	if err := initHeartbeat(); err != nil {
+		eslog.Error("%s : "+err.Error(), os.Args[0])
+	} else if isHeartbeat() {
+		go runHeartbeat()
+	}
 
 	for name, check := range g_queryList {
-		go launchQuery(check, name, env)
+		go launchQuery(check, name, env, nil)
 	}
 
 	if isServer() {
@@ -81,27 +114,57 @@ func main() {
 	}
 }
 
+// waitShutdown writes what is kept in memory before eschecker is stopped
+func waitShutdown() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	eslog.Info("%s : %s received, exiting", os.Args[0], sig)
+	saveHistory()
+	os.Exit(0)
+}
+
 func launchServer() {
 	path, port := serverPath(), serverPort()
-	var auth *BasicAuth
 
 	eslog.Info("%s : launching server on path %s and port %s", os.Args[0], path, port)
+	//the dashboard, and the stats in json for the scripts
+	handleServerPath(path, collectorDashboard)
+	handleServerPath(strings.TrimSuffix(path, "/")+"/json", collectorDisplay)
+	//the management API of the queries
+	api := strings.TrimSuffix(path, "/") + API_PATH
+	handleServerPath(api, newAPIHandler(api))
+	handleServerPath(api+"/", newAPIHandler(api))
+	//the links to acknowledge the alerts
+	ack := strings.TrimSuffix(path, "/") + ACK_PATH
+	handleServerPath(ack, newAckHandler(ack))
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+
+func handleServerPath(path string, display func(http.ResponseWriter, *http.Request)) {
 	if IsServerAuthentication() {
-		auth = NewBasicAuth(getServerLogin(), getServerPassword())
-		auth.setDisplayFunc(collectorDisplay)
+		auth := NewBasicAuth(getServerLogin(), getServerPassword())
+		auth.setDisplayFunc(display)
 		http.HandleFunc(path, auth.BasicAuthHandler)
 	} else {
-		http.HandleFunc(path, collectorDisplay)
+		http.HandleFunc(path, display)
 	}
-	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
 
-// function that handles the life of each query
-func launchQuery(c queries.Query, name string, env *Env) {
+// function that handles the life of each query. The queries of the API come
+// with their control, already registered.
+func launchQuery(c queries.Query, name string, env *Env, control *queryControl) {
+	if control == nil {
+		control = newPendingControl(name)
+		registerControl(control)
+	}
+	defer close(control.done)
 	schedule := new(scheduler)
 	retries := getMaxRetries()
 	send := new(sender)
-	stats := queryStats{true, false, retries, 0, "None"}
+	stats := newQueryStats()
+	stats.Tries = retries
+	failures := 0
 	var query elastic.Query
 
 	//query initiation
@@ -110,100 +173,229 @@ func launchQuery(c queries.Query, name string, env *Env) {
 	query, err := c.BuildQuery()
 	if err != nil {
 		eslog.Error("%s : failed to build query, %s", name, err.Error())
+		adminQueryFailed(name, err)
 		stats.IsUp = false
 		if isServer() {
 			go collectorUpdate(stats, name)
 		}
+		//reported by the admin actions, not by the heartbeat
+		if control.isRegistered() {
+			heartbeatForget(name)
+			useDigests(name, nil)
+		}
+		unregisterControl(control)
 		return
 	}
 
 	//scheduler and sender initiation
-	schedInfo, ok := env.queries[strings.ToLower(name)]
+	schedInfo, ok := getQueryInfo(strings.ToLower(name))
 	if ok {
 		schedule.initScheduler(&schedInfo)
 	} else {
 		schedule.initSchedulerDefault()
 	}
+	severity, err := getSeverity(schedInfo.Severity)
+	if err != nil {
+		eslog.Warning("%s : %s", name, err.Error())
+	}
+	stats.Severity = severity
+	if schedInfo.Max_retries != 0 {
+		retries = schedInfo.Max_retries
+		stats.Tries = retries
+	}
+	partialPolicy, err := getPartialPolicy(schedInfo.Partial_results, getPartialResults())
+	if err != nil {
+		eslog.Warning("%s : %s", name, err.Error())
+	}
+	err = schedule.initRetries(retries, getRetryBackoff(), getSuspendSchedule())
+	if err != nil {
+		eslog.Warning("%s : %s", name, err.Error())
+	}
 	err = send.initSender(&schedInfo)
 	if err != nil {
 		eslog.Error("%s : initSender failed, %s", name, err.Error())
+		adminQueryFailed(name, err)
 		stats.IsUp = false
 		if isServer() {
 			go collectorUpdate(stats, name)
 		}
+		//reported by the admin actions, not by the heartbeat
+		if control.isRegistered() {
+			heartbeatForget(name)
+			useDigests(name, nil)
+		}
+		unregisterControl(control)
 		return
 	}
+	//autoqueries can use the cluster to get more documents for their actions
+	if auto, ok := c.(*autoQuery); ok {
+		auto.cluster = env.cluster
+		if send.check == nil && !auto.needsDocuments() {
+			eslog.Info("%s : the documents are not displayed, counting them only", name)
+			send.countOnly = true
+		}
+	}
+	//the management API controls the query through its scheduler
+	control.start(getQueryConfig(&schedInfo, schedule, send, partialPolicy), send.timeOut)
+	schedule.control = control
 	eslog.Info("%s : Starting...", name)
-
-	//loop forever
-	for {
-		//try to send request. If fails, continue while decreasing attempts, or
-		//die if retries reach 0.
-		env.semaphore <- struct{}{}
-		results, err := send.SendRequest(env.client, query)
-		<-env.semaphore
+	heartbeatBeat(name, send.timeOut)
+
+	//loop until the query is deleted or replaced by the API
+	for !control.isStopped() {
+		//try to send request. If fails, retry sooner and sooner while decreasing
+		//attempts, or suspend the query if retries reach 0.
+		results, err := send.sendTo(env.cluster, query)
+		if err == nil {
+			err = checkPartial(name, partialPolicy, results, &stats)
+		}
 
 		if err != nil {
-			eslog.Error(err.Error())
+			eslog.Error("%s : %s", name, err.Error())
+			countError(&stats, err)
+			failures++
+			if stats.Suspended {
+				eslog.Warning("%s : query still failing, next attempt in %s", name, schedule.suspendSchedule)
+				stats.setRun(schedule.suspendSchedule)
+				if isServer() {
+					go collectorUpdate(stats, name)
+				}
+				heartbeatBeat(name, schedule.suspendSchedule+send.timeOut)
+				schedule.waitSuspended()
+				continue
+			}
 			stats.Tries -= 1
 			if stats.Tries == 0 {
-				eslog.Error("%s : max attempts reached, stopping query", name)
+				eslog.Error("%s : max attempts reached, suspending query for %s", name, schedule.suspendSchedule)
 				stats.IsUp = false
+				stats.Suspended = true
+				adminQuerySuspended(name, err, schedule.suspendSchedule)
+				stats.setRun(schedule.suspendSchedule)
 				if isServer() {
 					go collectorUpdate(stats, name)
 				}
-				return
+				heartbeatBeat(name, schedule.suspendSchedule+send.timeOut)
+				schedule.waitSuspended()
+				continue
 			} else {
-				//retry after schedule
+				//retry after backoff
 				eslog.Warning("%s : failed to connect, number of attempts left : %d", name, stats.Tries)
+				backoff := schedule.getBackoff(failures)
+				stats.setRun(backoff)
 				if isServer() {
 					go collectorUpdate(stats, name)
 				}
-				schedule.wait()
+				heartbeatBeat(name, schedule.waitSchedule+send.timeOut)
+				schedule.sleep(backoff)
 				continue
 			}
 		}
 
+		//request succeeded, restart attempts
+		failures = 0
+		stats.Tries = schedule.maxRetries
+		if stats.Suspended {
+			eslog.Info("%s : query is working again, resuming", name)
+			adminQueryResumed(name)
+			stats.Suspended = false
+			stats.IsUp = true
+		}
+
 		// interpet the results, if any
 		if results != nil && results.Hits != nil && results.Hits.TotalHits > 0 {
-			//request succeeded, restart attempts
-			stats.Tries = getMaxRetries()
 			eslog.Warning("%s : found a total of %d results", name, results.Hits.TotalHits)
 			yes := c.CheckCondition(results)
 			if yes {
-				//condition is verified. Should we enter alert status ?
-				if !schedule.isAlertOnlyOnce || (schedule.isAlertOnlyOnce && !schedule.alertState) {
-					eslog.Alert("%s : Action triggered", name)
-					c.DoAction(results)
+				//a new alert gets an id, to be acknowledged
+				newAlert := !schedule.alertState
+				id := ""
+				if newAlert {
+					id = startAlert(name)
+					if auto, ok := c.(*autoQuery); ok {
+						auto.alertId, auto.ackLink = id, getAckLink(id)
+					}
+				}
+				//condition is verified. Should we enter alert status ? An
+				//acknowledged alert is not notified again.
+				if (!schedule.isAlertOnlyOnce || (schedule.isAlertOnlyOnce && !schedule.alertState)) && !isAcked(name) {
+					muted := control.isMuted()
+					if muted {
+						eslog.Alert("%s : Action not triggered, the query is muted (%s)", name, severity)
+					} else {
+						eslog.Alert("%s : Action triggered (%s)", name, severity)
+						c.DoAction(results)
+					}
+					if newAlert {
+						historyStart(name, id, results.Hits.TotalHits, getActionNames(c), muted)
+					} else if !muted {
+						historyRepeat(name)
+					}
 					schedule.alertState = true
 					stats.AlertStatus = true
 					stats.LastAlert = time.Now().Format(TIMELAYOUT)
 					stats.NbAlerts++
 				}
+				//an alert not acknowledged is escalated after the delays of its policy
+				if esc := getEscalation(c); esc != nil {
+					if newAlert {
+						esc.start(id, getAckLink(id), results, control)
+					} else {
+						esc.update(results)
+					}
+				}
 			} else if !yes {
 				//condition not verified. Exiting alert status, triggering onAlertEnd() if necessary
-				if schedule.alertState == true && schedule.isAlertEndMsg == true {
-					c.OnAlertEnd()
-				}
-				schedule.alertState = false
+				stopAlert(c, name, schedule, control, results.Hits.TotalHits)
 				stats.AlertStatus = false
 			}
 		} else {
 			// no results found
 			eslog.Info("%s : no result found", name)
-			if schedule.alertState == true && schedule.isAlertEndMsg == true {
-				c.OnAlertEnd()
-			}
-			schedule.alertState = false
+			stopAlert(c, name, schedule, control, 0)
 			stats.AlertStatus = false
 		}
 		//update the stats and display them, if necessary
+		stats.Hits = addHits(stats.Hits, results)
+		stats.setRun(schedule.waitSchedule)
+		setAckStats(&stats, name)
 		if isServer() {
 			go collectorUpdate(stats, name)
 		}
 		//wait, and do it again
+		heartbeatBeat(name, schedule.waitSchedule+send.timeOut)
 		schedule.wait()
 	}
+	if esc := getEscalation(c); esc != nil {
+		esc.stop(false)
+	}
+	//a query deleted by the API is already forgotten, and a new one may watch it
+	if control.isRegistered() {
+		heartbeatForget(name)
+	}
+	eslog.Info("%s : stopped", name)
+}
+
+// stopAlert exits the alert status, triggering onAlertEnd() if necessary
+func stopAlert(c queries.Query, name string, schedule *scheduler, control *queryControl, hits int64) {
+	ack, _ := endAlert(name)
+	if schedule.alertState {
+		var actions []string
+		muted := false
+		if schedule.isAlertEndMsg {
+			actions = getActionNames(c)
+			if muted = control.isMuted(); !muted {
+				c.OnAlertEnd()
+			}
+		}
+		historyEnd(name, ack, hits, actions, muted)
+		if auto, ok := c.(*autoQuery); ok {
+			auto.recordEnd()
+		}
+		if esc := getEscalation(c); esc != nil {
+			esc.stop(schedule.isAlertEndMsg && !muted)
+		}
+	}
+	schedule.alertState = false
 }
 
 func (e *Env) connect() {
@@ -215,20 +407,31 @@ func (e *Env) connect() {
 	}
 
 	eslog.Info("%s : connection attempt to %s", os.Args[0], config.Cluster_addr)
-	if isAuthentication() {
-		e.client, err = elastic.NewClient(
-			elastic.SetSniff(false),
-			elastic.SetURL(config.Cluster_addr),
-			elastic.SetBasicAuth(getAuthLogin(), getAuthPassword()))
-	} else {
-		e.client, err = elastic.NewClient(elastic.SetSniff(false),
-			elastic.SetURL(config.Cluster_addr))
+	//without cluster_proxy, the default client uses the proxy of the environment
+	var httpClient *http.Client
+	if len(config.Cluster_proxy) > 0 {
+		httpClient, err = eshttp.NewClient(config.Cluster_proxy)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		//the searches have their own timeout, which can be longer
+		httpClient.Timeout = 0
 	}
+	//the searches are sent by the cluster, so that they can be cancelled
+	e.cluster, err = newCluster(httpClient)
 	if err != nil {
+		eslog.Error("%s : "+err.Error(), os.Args[0])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CLUSTER_CHECK_TIMEOUT)
+	defer cancel()
+	if _, err = e.cluster.performRequest(ctx, "GET", "/", nil, nil); err != nil {
 		log.Fatal(err.Error())
 	} else {
 		eslog.Info("%s : connection succeeded", os.Args[0])
 	}
+	if e.cluster.isBatching() {
+		go e.cluster.run()
+	}
 }
 
 func (e *Env) getFlags() {
@@ -293,8 +496,6 @@ func (e *Env) parseQueries() int {
 // function to check query list, try to init them and build query, and exit with
 // displaying relevant errors, if any
 func (e *Env) checkAndExit() {
-	var err bool
-	var err2 error
 	var errcount uint32
 
 	if len(g_queryList) == 0 {
@@ -302,35 +503,15 @@ func (e *Env) checkAndExit() {
 		errcount++
 	}
 
+	for _, err := range checkRouting() {
+		eslog.Error("%s : routing, %s", os.Args[0], err.Error())
+		errcount++
+	}
 	for k, v := range g_queryList {
 		eslog.Info("%s : initiating...", k)
-		err = v.SetQueryConfig(config.G_Config.ManualConfig.List)
-		if err {
-			eslog.Error("%s : failed to get config", k)
-			errcount++
-			continue
-		}
-		_, err2 = v.BuildQuery()
-		if err2 != nil {
-			eslog.Error("%s : error while building query, %s", k, err2.Error())
-			errcount++
-		}
-
-		//test scheduler and sender
-		schedule := new(scheduler)
-		send := new(sender)
-		schedInfo, ok := e.queries[strings.ToLower(k)]
-		if ok {
-			if errinit := schedule.initScheduler(&schedInfo); errinit != nil {
-				eslog.Error("%s : error in schedule info, %s", k, errinit.Error())
-				errcount++
-			}
-		} else {
-			eslog.Error("%s : error while getting query info in yaml", k)
-			errcount++
-		}
-		if err2 = send.initSender(&schedInfo); err2 != nil {
-			eslog.Error("%s : error while getting query information, %s", k, err2.Error())
+		schedInfo, ok := getQueryInfo(strings.ToLower(k))
+		for _, err := range checkQuery(v, &schedInfo, ok) {
+			eslog.Error("%s : %s", k, err.Error())
 			errcount++
 		}
 	}
@@ -343,9 +524,64 @@ func (e *Env) checkAndExit() {
 	os.Exit(0)
 }
 
+// checkQuery inits a query, its scheduler and its sender like launchQuery, and
+// gives the errors found. ok tells if the query has a config in the yml.
+func checkQuery(q queries.Query, schedInfo *config.Query, ok bool) []error {
+	var errs []error
+	var err error
+
+	if auto, isAuto := q.(*autoQuery); isAuto {
+		//set again when the query is launched
+		auto.checkOnly = true
+		err = auto.setConfig()
+		auto.checkOnly = false
+	} else if q.SetQueryConfig(config.G_Config.ManualConfig.List) {
+		err = errors.New("failed to get config")
+	}
+	if err != nil {
+		return []error{err}
+	}
+	if _, err = q.BuildQuery(); err != nil {
+		errs = append(errs, fmt.Errorf("error while building query, %s", err.Error()))
+	}
+
+	//test scheduler and sender
+	schedule := new(scheduler)
+	send := new(sender)
+	if ok {
+		if err = schedule.initScheduler(schedInfo); err != nil {
+			errs = append(errs, fmt.Errorf("error in schedule info, %s", err.Error()))
+		}
+	} else {
+		errs = append(errs, errors.New("error while getting query info in yaml"))
+	}
+	if err = send.initSender(schedInfo); err != nil {
+		errs = append(errs, fmt.Errorf("error while getting query information, %s", err.Error()))
+	}
+	if _, err = getPartialPolicy(schedInfo.Partial_results, getPartialResults()); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
 func (e *Env) initIntegrations() {
+	eshttp.Init()
 	esmail.Init()
 	esslack.Init()
+	initIndex()
+}
+
+func (e *Env) initOutbox() {
+	if isAdmin() {
+		esoutbox.SetFailureHandler(adminDeliveryFailure)
+		esoutbox.SetSuccessHandler(adminDeliverySuccess)
+	} else {
+		esoutbox.SetFailureHandler(collectorDeliveryFailure)
+		esoutbox.SetSuccessHandler(historyDeliverySuccess)
+	}
+	if err := esoutbox.Init(); err != nil {
+		eslog.Error("%s : outbox : "+err.Error(), os.Args[0])
+	}
 }
 
 func (e *Env) initRotatingLog() {
@@ -384,6 +620,22 @@ func getMaxRetries() int {
 	return config.G_Config.Config.Max_retries
 }
 
+func getRetryBackoff() string {
+	return config.G_Config.Config.Retry_backoff
+}
+
+func getSuspendSchedule() string {
+	return config.G_Config.Config.Suspend_schedule
+}
+
+func getPartialResults() string {
+	return config.G_Config.Config.Partial_results
+}
+
+func isPartialNotify() bool {
+	return config.G_Config.Config.Partial_results_notify
+}
+
 func getNbWorkers() int {
 	return config.G_Config.Config.Workers
 }
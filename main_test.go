@@ -137,10 +137,15 @@ func TestDummyYaml1(t *testing.T) {
 	assert.Equal(t, []string{"jean-mich@example.com", "gerard@example.com"}, autoTest1.mail.EndAlertMail.GetRecipients())
 
 	//slack
-	msg := "https://slack.com/api/chat.postMessage?username=Chicharito&token=" + "kikooletoken42" + "&channel=%23general&pretty=1&text=Y+a+un+probleme+mec"
-	assert.Equal(t, msg, autoTest1.slack.msg.GetSlackRequest())
-	msgEnd := "https://slack.com/api/chat.postMessage?username=Chicharito&token=" + "kikooletoken42" + "&channel=%23general&pretty=1&text=End+of+alert+for+test1"
-	assert.Equal(t, msgEnd, autoTest1.slack.endMsg.GetSlackRequest())
+	msg, err := autoTest1.slack.msg.GetSlackPayload()
+	assert.Nil(t, err)
+	assert.Contains(t, string(msg), `"text":"Y a un probleme mec"`)
+	assert.Contains(t, string(msg), `"channel":"#general"`)
+	assert.Contains(t, string(msg), `"username":"Chicharito"`)
+	msgEnd, err := autoTest1.slack.endMsg.GetSlackPayload()
+	assert.Nil(t, err)
+	assert.Contains(t, string(msgEnd), `"text":"End of alert for test1"`)
+	assert.Contains(t, string(msgEnd), `"color":"good"`)
 	assert.Equal(t, "Alert Elastic: Test titre !!!", autoTest1.mail.AlertMail.GetSubject())
 	assert.Equal(t, "Y a un probleme mec", autoTest1.mail.body)
 
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/eslog"
+	"gopkg.in/olivere/elastic.v2"
+)
+
+/*
+** When some shards fail or time out, elasticsearch still answers with the
+** documents of the other ones: the count is too low, and may hide an alert.
+** Such results are degraded, and are treated as an error, used with a warning,
+** or used as is, depending on partial_results.
+ */
+
+const (
+	PARTIAL_ERROR  = "error"
+	PARTIAL_WARN   = "warn"
+	PARTIAL_IGNORE = "ignore"
+	ERROR_PARTIAL  = "partial"
+)
+
+// getPartialPolicy gives the policy of a query, the global one if it has none
+func getPartialPolicy(query string, global string) (string, error) {
+	policy := query
+	if policy == "" {
+		policy = global
+	}
+	switch policy {
+	case "":
+		return PARTIAL_WARN, nil
+	case PARTIAL_ERROR, PARTIAL_WARN, PARTIAL_IGNORE:
+		return policy, nil
+	}
+	return PARTIAL_WARN, errors.New("wrong partial_results " + policy + ", use error, warn or ignore")
+}
+
+// getPartialError tells why the results are incomplete, nil if they are not
+func getPartialError(results *elastic.SearchResult) error {
+	if results == nil {
+		return nil
+	}
+	if results.Shards != nil && results.Shards.Failed > 0 {
+		return &requestError{ERROR_PARTIAL, fmt.Errorf("%d of %d shards failed", results.Shards.Failed, results.Shards.Total)}
+	}
+	if results.TimedOut {
+		return &requestError{ERROR_PARTIAL, errors.New("the search timed out before all the shards answered")}
+	}
+	return nil
+}
+
+// checkPartial applies the policy to the results and updates the stats. It
+// gives an error if the results must be treated as a failure.
+func checkPartial(name string, policy string, results *elastic.SearchResult, stats *queryStats) error {
+	partial := getPartialError(results)
+	if partial == nil || policy == PARTIAL_IGNORE {
+		if stats.Degraded {
+			stats.Degraded = false
+			adminQueryComplete(name)
+		}
+		return nil
+	}
+	stats.Degraded = true
+	adminQueryDegraded(name, partial)
+	if policy == PARTIAL_ERROR {
+		return partial
+	}
+	eslog.Warning("%s : %s, the results may be incomplete", name, partial.Error())
+	stats.PartialResults++
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"testing"
+)
+
+func getResult(t *testing.T, content string) *elastic.SearchResult {
+	ret := new(elastic.SearchResult)
+	assert.Nil(t, json.Unmarshal([]byte(content), ret))
+	return ret
+}
+
+func Test_PartialPolicy(t *testing.T) {
+	policy, err := getPartialPolicy("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, PARTIAL_WARN, policy)
+	policy, err = getPartialPolicy("", "error")
+	assert.Nil(t, err)
+	assert.Equal(t, PARTIAL_ERROR, policy)
+	policy, err = getPartialPolicy("ignore", "error")
+	assert.Nil(t, err)
+	assert.Equal(t, PARTIAL_IGNORE, policy)
+	policy, err = getPartialPolicy("pouet", "")
+	assert.NotNil(t, err)
+	assert.Equal(t, PARTIAL_WARN, policy)
+}
+
+func Test_PartialError(t *testing.T) {
+	assert.Nil(t, getPartialError(nil))
+	assert.Nil(t, getPartialError(getResult(t, `{"_shards":{"total":5,"successful":5,"failed":0},"hits":{"total":2}}`)))
+
+	err := getPartialError(getResult(t, `{"_shards":{"total":5,"successful":3,"failed":2},"hits":{"total":2}}`))
+	assert.Equal(t, ERROR_PARTIAL, getErrorKind(err))
+	assert.Equal(t, "partial error : 2 of 5 shards failed", err.Error())
+
+	err = getPartialError(getResult(t, `{"timed_out":true,"hits":{"total":2}}`))
+	assert.Equal(t, ERROR_PARTIAL, getErrorKind(err))
+}
+
+func Test_CheckPartial(t *testing.T) {
+	var sent []adminSent
+
+	eslog.InitSilent()
+	config.G_Config.Config = &config.Config{Partial_results_notify: true}
+	g_adminSend = func(subject string, text string, recovery bool) {
+		sent = append(sent, adminSent{subject, recovery})
+	}
+	defer func() { g_adminSend = sendAdminNotification }()
+	partial := getResult(t, `{"_shards":{"total":5,"successful":4,"failed":1},"hits":{"total":2}}`)
+	complete := getResult(t, `{"_shards":{"total":5,"successful":5,"failed":0},"hits":{"total":2}}`)
+	stats := queryStats{}
+
+	//warned: the results are used, and counted
+	assert.Nil(t, checkPartial("q1", PARTIAL_WARN, partial, &stats))
+	assert.True(t, stats.Degraded)
+	assert.Equal(t, 1, stats.PartialResults)
+
+	//back to complete results
+	assert.Nil(t, checkPartial("q1", PARTIAL_WARN, complete, &stats))
+	assert.False(t, stats.Degraded)
+	assert.Equal(t, []adminSent{
+		{"eschecker: query q1 degraded", false},
+		{"eschecker: query q1 complete", true},
+	}, sent)
+
+	//treated as a failure, counted by countError
+	err := checkPartial("q1", PARTIAL_ERROR, partial, &stats)
+	assert.NotNil(t, err)
+	assert.True(t, stats.Degraded)
+	countError(&stats, err)
+	assert.Equal(t, 2, stats.PartialResults)
+
+	//ignored
+	stats = queryStats{}
+	assert.Nil(t, checkPartial("q2", PARTIAL_IGNORE, partial, &stats))
+	assert.False(t, stats.Degraded)
+	assert.Equal(t, 0, stats.PartialResults)
+	adminQueryComplete("q1")
+}
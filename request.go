@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+** Requests to the cluster, cancelled with a context: when a query gives up,
+** the http request is stopped too. The errors tell if the request timed out,
+** couldn't reach the cluster, or was refused by elasticsearch.
+ */
+
+const (
+	ERROR_TIMEOUT   = "timeout"
+	ERROR_TRANSPORT = "transport"
+	ERROR_QUERY     = "query"
+)
+
+// requestError is an error of a request to the cluster, with its kind
+type requestError struct {
+	kind string
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.kind + " error : " + e.err.Error()
+}
+
+// getErrorKind gives the kind of an error, transport by default
+func getErrorKind(err error) string {
+	if e, ok := err.(*requestError); ok {
+		return e.kind
+	}
+	return ERROR_TRANSPORT
+}
+
+func newTimeoutError(format string, v ...interface{}) error {
+	return &requestError{ERROR_TIMEOUT, fmt.Errorf(format, v...)}
+}
+
+// performRequest sends a request to the cluster and gives the body of the
+// response. body is sent as is if it is a string, else as json.
+func (c *cluster) performRequest(ctx context.Context, method string, path string, params url.Values, body interface{}) ([]byte, error) {
+	var reader *bytes.Reader
+
+	u := c.url + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	switch b := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(b))
+	default:
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, &requestError{ERROR_QUERY, err}
+		}
+		reader = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, &requestError{ERROR_QUERY, err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.login != "" && c.password != "" {
+		req.SetBasicAuth(c.login, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, classifyError(ctx, err)
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, classifyError(ctx, err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, getResponseError(resp.StatusCode, content)
+	}
+	return content, nil
+}
+
+func classifyError(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &requestError{ERROR_TIMEOUT, errors.New("no response before the timeout")}
+	}
+	return &requestError{ERROR_TRANSPORT, err}
+}
+
+// getResponseError reads the error sent by elasticsearch. A response without
+// an error of elasticsearch comes from something else, like a proxy.
+func getResponseError(status int, content []byte) error {
+	var res struct {
+		Error interface{} `json:"error"`
+	}
+
+	if json.Unmarshal(content, &res) == nil && res.Error != nil {
+		if status == http.StatusServiceUnavailable {
+			return &requestError{ERROR_TRANSPORT, fmt.Errorf("%d %v", status, res.Error)}
+		}
+		return &requestError{ERROR_QUERY, fmt.Errorf("%d %v", status, res.Error)}
+	}
+	return &requestError{ERROR_TRANSPORT, fmt.Errorf("%d %s", status, strings.TrimSpace(string(content)))}
+}
+
+// getESTimeout writes a duration for the timeout parameter of elasticsearch
+func getESTimeout(d time.Duration) string {
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
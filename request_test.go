@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"github.com/amundi/escheck/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_PerformRequest(t *testing.T) {
+	var body string
+	var login, password string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		body = string(content)
+		login, password, _ = r.BasicAuth()
+		switch r.URL.Path {
+		case "/ok/_search":
+			w.Write([]byte(`{"hits":{"total":3,"hits":[]}}`))
+		case "/bad/_search":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"SearchPhaseExecutionException[Failed to execute phase [query]]","status":400}`))
+		case "/proxy/_search":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("Bad Gateway"))
+		case "/slow/_search":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+
+	config.G_Config.Config = &config.Config{Cluster_addr: server.URL + "/", Auth_login: "user", Auth_password: "pass"}
+	c, err := newCluster(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL, c.url)
+	query := elastic.NewTermFilter("status", "ok")
+
+	//success, with the timeout given to elasticsearch
+	s := &sender{index: "ok", nbDocs: 10, timeOut: time.Second}
+	res, err := s.SendRequest(c, query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), res.Hits.TotalHits)
+	assert.True(t, strings.Contains(body, `"timeout":"1000ms"`))
+	assert.Equal(t, "user", login)
+	assert.Equal(t, "pass", password)
+
+	//refused by elasticsearch
+	s.index = "bad"
+	_, err = s.SendRequest(c, query)
+	assert.Equal(t, ERROR_QUERY, getErrorKind(err))
+	assert.True(t, strings.Contains(err.Error(), "SearchPhaseExecutionException"))
+
+	//an error page that doesn't come from elasticsearch
+	s.index = "proxy"
+	_, err = s.SendRequest(c, query)
+	assert.Equal(t, ERROR_TRANSPORT, getErrorKind(err))
+
+	//the request is cancelled when the timeout is reached
+	s.index = "slow"
+	s.timeOut = 50 * time.Millisecond
+	start := time.Now()
+	_, err = s.SendRequest(c, query)
+	assert.Equal(t, ERROR_TIMEOUT, getErrorKind(err))
+	assert.True(t, time.Since(start) < time.Second)
+
+	//the cluster can't be reached
+	server.Close()
+	_, err = c.performRequest(context.Background(), "GET", "/", nil, nil)
+	assert.Equal(t, ERROR_TRANSPORT, getErrorKind(err))
+}
+
+func Test_CountError(t *testing.T) {
+	s := queryStats{}
+	countError(&s, newTimeoutError("too slow"))
+	countError(&s, getResponseError(400, []byte(`{"error":"parse"}`)))
+	countError(&s, getResponseError(503, []byte(`{"error":"no master"}`)))
+	assert.Equal(t, 1, s.Timeouts)
+	assert.Equal(t, 1, s.QueryErrors)
+	assert.Equal(t, 1, s.TransportErrors)
+	assert.Equal(t, "transport error : 503 no master", s.LastError)
+	assert.Equal(t, "30000ms", getESTimeout(30*time.Second))
+}
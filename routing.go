@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amundi/escheck/config"
+	"strings"
+)
+
+/*
+** Each query has a severity, info, warning or critical, and labels. The first
+** route of the routing matching them gives the receivers notified, in addition
+** to the actions of the query. A receiver is a set of actions like the ones of a
+** query, and can be in digest mode: the queries sending to it share its summary.
+ */
+
+const (
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_CRITICAL = "critical"
+	SEVERITY_DEFAULT  = SEVERITY_WARNING
+)
+
+func isSeverity(severity string) bool {
+	switch severity {
+	case SEVERITY_INFO, SEVERITY_WARNING, SEVERITY_CRITICAL:
+		return true
+	}
+	return false
+}
+
+// getSeverity gives the severity of a query, the default one if not set
+func getSeverity(severity string) (string, error) {
+	if severity == "" {
+		return SEVERITY_DEFAULT, nil
+	}
+	severity = strings.ToLower(severity)
+	if !isSeverity(severity) {
+		return SEVERITY_DEFAULT, fmt.Errorf("unknown severity %s, only: info, warning, critical", severity)
+	}
+	return severity, nil
+}
+
+// getRoute gives the first route matching the severity and labels, nil if none
+func getRoute(severity string, labels map[string]string) *config.Route {
+	routing := config.G_Config.Config.Routing
+	for i := range routing {
+		if matchRoute(&routing[i], severity, labels) {
+			return &routing[i]
+		}
+	}
+	return nil
+}
+
+// matchRoute tells if a query has the severity and all the labels of the route.
+// A route without severity matches them all.
+func matchRoute(route *config.Route, severity string, labels map[string]string) bool {
+	if route.Severity != "" && strings.ToLower(route.Severity) != severity {
+		return false
+	}
+	for key, value := range route.Labels {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRouting gives the errors of the routing, receivers and escalation
+// policies of the config
+func checkRouting() []error {
+	var errs []error
+
+	for i, route := range config.G_Config.Config.Routing {
+		if route.Severity != "" && !isSeverity(strings.ToLower(route.Severity)) {
+			errs = append(errs, fmt.Errorf("route %d, unknown severity %s", i+1, route.Severity))
+		}
+		if len(route.Receivers) == 0 {
+			errs = append(errs, fmt.Errorf("route %d, no receivers", i+1))
+		}
+		for _, name := range route.Receivers {
+			if _, ok := config.G_Config.Config.Receivers[name]; !ok {
+				errs = append(errs, fmt.Errorf("route %d, unknown receiver %s", i+1, name))
+			}
+		}
+	}
+	//the policies are checked with a query using them
+	for policy := range config.G_Config.Config.Escalations {
+		a := &autoQuery{name: "escalation " + policy, checkOnly: true}
+		if _, err := a.newEscalation(policy, new(config.Query)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// initReceivers creates the receivers of the route matching the query. Each
+// one is an autoquery of the same name, doing only the actions of the receiver.
+func (a *autoQuery) initReceivers(info *config.Query) error {
+	a.receivers = nil
+	route := getRoute(a.severity, info.Labels)
+	if route == nil {
+		return nil
+	}
+	receivers, err := a.newReceivers(route.Receivers, info)
+	a.receivers = receivers
+	return err
+}
+
+// newReceivers gives the autoqueries doing the actions of the receivers for
+// the query
+func (a *autoQuery) newReceivers(names []string, info *config.Query) ([]*autoQuery, error) {
+	var ret []*autoQuery
+
+	for _, name := range names {
+		receiver, ok := config.G_Config.Config.Receivers[name]
+		if !ok {
+			return nil, errors.New("unknown receiver " + name)
+		}
+		receiverInfo := *info
+		receiverInfo.Actions = receiver.Actions
+		receiverInfo.Digest = receiver.Digest
+		r := &autoQuery{name: a.name, info: &receiverInfo, receiver: name, checkOnly: a.checkOnly}
+		if err := r.setConfig(); err != nil {
+			return nil, fmt.Errorf("receiver %s, %s", name, err.Error())
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
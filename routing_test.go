@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
+	"gopkg.in/yaml.v2"
+	"testing"
+	"time"
+)
+
+const testRouting = `
+routing:
+  - severity: critical
+    labels:
+      team: db
+    receivers: [oncall, dbteam]
+  - severity: critical
+    receivers: [oncall]
+  - severity: info
+    receivers: [lowpriority]
+receivers:
+  oncall:
+    list: [email]
+    email:
+      to: [oncall@example.com]
+      title: Incident
+  dbteam:
+    list: [slack]
+    slack:
+      channel: "#db"
+  lowpriority:
+    digest: 1h
+    list: [slack]
+    slack:
+      channel: "#info"
+querylist:
+  dbdown:
+    severity: CRITICAL
+    labels:
+      team: db
+    query:
+      index: logs*
+    actions:
+      list: [slack]
+      slack:
+        channel: "#alerts"
+  lowdisk:
+    severity: info
+    query:
+      index: logs*
+  errors:
+    query:
+      index: logs*
+    actions:
+      list: [email]
+      email:
+        to: [dev@example.com]
+        title: Errors
+`
+
+func initRoutingForTests(t *testing.T) {
+	eslog.InitSilent()
+	config.G_Config.Config = new(config.Config)
+	assert.Nil(t, yaml.Unmarshal([]byte(testRouting), config.G_Config.Config))
+}
+
+func Test_Severity(t *testing.T) {
+	severity, err := getSeverity("")
+	assert.Nil(t, err)
+	assert.Equal(t, SEVERITY_WARNING, severity)
+	severity, err = getSeverity("Critical")
+	assert.Nil(t, err)
+	assert.Equal(t, SEVERITY_CRITICAL, severity)
+	severity, err = getSeverity("urgent")
+	assert.NotNil(t, err)
+	assert.Equal(t, SEVERITY_DEFAULT, severity)
+}
+
+func Test_Routes(t *testing.T) {
+	initRoutingForTests(t)
+	assert.Equal(t, 0, len(checkRouting()))
+	assert.Equal(t, []string{"oncall", "dbteam"}, getRoute(SEVERITY_CRITICAL, map[string]string{"team": "db", "site": "paris"}).Receivers)
+	assert.Equal(t, []string{"oncall"}, getRoute(SEVERITY_CRITICAL, map[string]string{"team": "web"}).Receivers)
+	assert.Equal(t, []string{"oncall"}, getRoute(SEVERITY_CRITICAL, nil).Receivers)
+	assert.Nil(t, getRoute(SEVERITY_WARNING, map[string]string{"team": "db"}))
+
+	//a route without severity matches them all
+	assert.True(t, matchRoute(&config.Route{}, SEVERITY_INFO, nil))
+
+	config.G_Config.Config.Routing = append(config.G_Config.Config.Routing,
+		config.Route{Severity: "urgent", Receivers: []string{"nobody"}}, config.Route{})
+	assert.Equal(t, 3, len(checkRouting()))
+}
+
+func Test_Receivers(t *testing.T) {
+	initRoutingForTests(t)
+
+	//the actions of the query, and the receivers of its route
+	a := &autoQuery{name: "dbdown"}
+	assert.Nil(t, a.setConfig())
+	assert.Equal(t, SEVERITY_CRITICAL, a.severity)
+	assert.Equal(t, 2, len(a.receivers))
+	assert.Equal(t, "oncall", a.receivers[0].receiver)
+	assert.Equal(t, SEVERITY_CRITICAL, a.receivers[0].severity)
+	assert.Equal(t, []string{"oncall@example.com"}, a.receivers[0].mail.AlertMail.GetRecipients())
+	assert.Equal(t, "Alert Elastic: [CRITICAL] Incident", a.receivers[0].mail.AlertMail.GetSubject())
+	assert.Equal(t, "dbdown", a.receivers[1].name)
+	assert.Nil(t, a.receivers[1].receivers)
+	assert.Equal(t, []string{"slack", "oncall", "dbteam"}, getActionNames(a))
+	assert.Equal(t, []actionMode{{"slack", MODE_DIRECT}, {"oncall", MODE_DIRECT}, {"dbteam", MODE_DIRECT}}, a.getActionModes())
+
+	//a receiver in digest mode
+	a = &autoQuery{name: "lowdisk"}
+	assert.Nil(t, a.setConfig())
+	assert.Equal(t, 1, len(a.receivers))
+	assert.NotNil(t, a.receivers[0].digest)
+	//the recovery goes to the digest of the receiver, even without end message
+	a.receivers[0].digest = newDigest(time.Hour, &config.Query{})
+	a.receivers[0].DoAction(&elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: 3}})
+	a.recordEnd()
+	_, rows := a.receivers[0].digest.getSummary()
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, "OK", rows[0][4])
+	assert.Equal(t, []actionMode{{"lowpriority", MODE_DIGEST}}, a.getActionModes())
+
+	//no route for the warnings
+	a = &autoQuery{name: "errors"}
+	assert.Nil(t, a.setConfig())
+	assert.Equal(t, SEVERITY_WARNING, a.severity)
+	assert.Nil(t, a.receivers)
+
+	//a route to an unknown receiver, or a wrong severity
+	delete(config.G_Config.Config.Receivers, "dbteam")
+	a = &autoQuery{name: "dbdown"}
+	assert.NotNil(t, a.setConfig())
+	info := config.G_Config.Config.QueryList["errors"]
+	info.Severity = "urgent"
+	config.G_Config.Config.QueryList["errors"] = info
+	a = &autoQuery{name: "errors"}
+	assert.NotNil(t, a.setConfig())
+}
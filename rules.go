@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/queries"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/*
+** Autoqueries created through the API, without editing config.yml. They are
+** kept in the querylist of rules_file, merged with the one of config.yml at
+** startup. The queries of config.yml can't be changed by the API.
+ */
+
+type rulesFile struct {
+	QueryList map[string]config.Query `yaml:"querylist"`
+}
+
+var g_rules = struct {
+	file    string
+	managed map[string]bool //the queries of the rules file
+	env     *Env
+	sync.Mutex
+}{managed: make(map[string]bool)}
+
+//starts the queries, replaced in the tests
+var g_ruleLaunch = struct {
+	launch func(queries.Query, string, *Env, *queryControl)
+	sync.Mutex
+}{launch: launchQuery}
+
+//protects the querylist of the config, changed by the API while queries start
+var g_queriesLock sync.RWMutex
+
+//names usable in the urls, in lower case like the lookups of the querylist
+var g_ruleName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+func getQueryInfo(name string) (config.Query, bool) {
+	g_queriesLock.RLock()
+	defer g_queriesLock.RUnlock()
+	info, ok := config.G_Config.Config.QueryList[name]
+	return info, ok
+}
+
+func isRules() bool {
+	return g_rules.file != ""
+}
+
+func isManaged(name string) bool {
+	g_rules.Lock()
+	defer g_rules.Unlock()
+	return g_rules.managed[name]
+}
+
+// loadRules adds the queries of the rules file to the querylist
+func (e *Env) loadRules() error {
+	var rules rulesFile
+
+	g_rules.file = config.G_Config.Config.Rules_file
+	g_rules.env = e
+	if !isRules() {
+		return nil
+	}
+	source, err := ioutil.ReadFile(g_rules.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(source, &rules); err != nil {
+		return err
+	}
+	if e.queries == nil {
+		e.queries = make(map[string]config.Query)
+		config.G_Config.Config.QueryList = e.queries
+	}
+	for name, info := range rules.QueryList {
+		if _, exists := e.queries[name]; exists {
+			eslog.Error("%s : query %s of %s is already in the config, ignored", os.Args[0], name, g_rules.file)
+			continue
+		}
+		e.queries[name] = info
+		g_rules.managed[name] = true
+	}
+	return nil
+}
+
+// checkRule tells if a query can be created or replaced with info, and gives
+// the autoquery to launch
+func checkRule(name string, info *config.Query) (*autoQuery, []error) {
+	if !g_ruleName.MatchString(name) {
+		return nil, []error{errors.New("the name must only have lower case letters, digits, _ and -")}
+	}
+	if info.Query.Type == "manual" {
+		return nil, []error{errors.New("manual queries can't be created by the API")}
+	}
+	a := &autoQuery{name: name, info: info}
+	if errs := checkQuery(a, info, true); len(errs) > 0 {
+		return nil, errs
+	}
+	return a, nil
+}
+
+// putRule saves the query in the rules file, and starts it instead of the
+// previous one of the same name
+func putRule(name string, info *config.Query, a *autoQuery) error {
+	g_rules.Lock()
+	defer g_rules.Unlock()
+	list := getRules()
+	list[name] = *info
+	if err := saveRules(list); err != nil {
+		return err
+	}
+	g_queriesLock.Lock()
+	if config.G_Config.Config.QueryList == nil {
+		config.G_Config.Config.QueryList = make(map[string]config.Query)
+	}
+	config.G_Config.Config.QueryList[name] = *info
+	g_queriesLock.Unlock()
+	g_rules.managed[name] = true
+	//the new loop starts once the previous one has ended its current run. Its
+	//control is registered at once, for the next PUT or DELETE to stop it.
+	old := getControl(name)
+	if old != nil {
+		old.stop()
+	}
+	control := newPendingControl(name)
+	registerControl(control)
+	resetStats(name)
+	eslog.Info("%s : query saved by the API, starting it", name)
+	launch, env := getRuleLaunch(), g_rules.env
+	go func() {
+		if old != nil {
+			old.wait()
+			resetStats(name)
+		}
+		launch(a, name, env, control)
+	}()
+	return nil
+}
+
+func getRuleLaunch() func(queries.Query, string, *Env, *queryControl) {
+	g_ruleLaunch.Lock()
+	defer g_ruleLaunch.Unlock()
+	return g_ruleLaunch.launch
+}
+
+func setRuleLaunch(launch func(queries.Query, string, *Env, *queryControl)) {
+	g_ruleLaunch.Lock()
+	defer g_ruleLaunch.Unlock()
+	g_ruleLaunch.launch = launch
+}
+
+// deleteRule stops the query and removes it from the rules file
+func deleteRule(name string) error {
+	g_rules.Lock()
+	defer g_rules.Unlock()
+	list := getRules()
+	delete(list, name)
+	if err := saveRules(list); err != nil {
+		return err
+	}
+	g_queriesLock.Lock()
+	delete(config.G_Config.Config.QueryList, name)
+	g_queriesLock.Unlock()
+	delete(g_rules.managed, name)
+	if c := getControl(name); c != nil {
+		c.stop()
+		unregisterControl(c)
+	}
+	heartbeatForget(name)
+	endAlert(name)
+	removeDigestQuery(name)
+	deleteHistory(name)
+	deleteStats(name)
+	eslog.Info("%s : query deleted by the API", name)
+	return nil
+}
+
+// getRules gives a copy of the queries of the rules file. g_rules must be locked.
+func getRules() map[string]config.Query {
+	ret := make(map[string]config.Query)
+	for name := range g_rules.managed {
+		if info, ok := getQueryInfo(name); ok {
+			ret[name] = info
+		}
+	}
+	return ret
+}
+
+// write then rename, so that the file is never half written
+func saveRules(list map[string]config.Query) error {
+	content, err := yaml.Marshal(rulesFile{list})
+	if err != nil {
+		return err
+	}
+	tmp := g_rules.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g_rules.file)
+}
+
+// decodeRule reads a query in the format of the querylist, in yaml or json
+func decodeRule(source []byte) (*config.Query, error) {
+	info := new(config.Query)
+	if strings.TrimSpace(string(source)) == "" {
+		return nil, errors.New("no query given")
+	}
+	if err := yaml.Unmarshal(source, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
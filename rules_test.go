@@ -0,0 +1,207 @@
+package main
+
+import (
+	"github.com/amundi/escheck/config"
+	"github.com/amundi/escheck/eslog"
+	"github.com/amundi/escheck/queries"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRule = `
+schedule: 1m
+timeout: 10s
+query:
+  index: logs*
+  type: boolfilter
+  limit: 1
+  clauses:
+    must:
+      - term: ["status", "Error"]
+`
+
+const testRuleJSON = `{"schedule": "5m", "query": {"index": "logs*", "type": "boolfilter",
+	"clauses": {"must": [{"term": ["status", "Error"]}]}}}`
+
+// initRulesForTests sets a config with a query in the yml, and a rules file
+func initRulesForTests(t *testing.T, rules string) (*Env, string) {
+	eslog.InitSilent()
+	dir, err := ioutil.TempDir("", "rules")
+	assert.Nil(t, err)
+	file := filepath.Join(dir, "rules.yml")
+	if rules != "" {
+		assert.Nil(t, ioutil.WriteFile(file, []byte(rules), 0600))
+	}
+	e := new(Env)
+	e.queries = map[string]config.Query{"fromyml": {Schedule: "1m"}}
+	config.G_Config.Config = &config.Config{Rules_file: file, QueryList: e.queries}
+	g_rules.managed = make(map[string]bool)
+	return e, dir
+}
+
+func Test_LoadRules(t *testing.T) {
+	e, dir := initRulesForTests(t, "querylist:\n  fromyml:\n    schedule: 2m\n  fromrules:\n    schedule: 3m\n")
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, e.loadRules())
+	assert.True(t, isRules())
+	//the queries of the yml win
+	info, ok := getQueryInfo("fromyml")
+	assert.True(t, ok)
+	assert.Equal(t, "1m", info.Schedule)
+	assert.False(t, isManaged("fromyml"))
+	info, ok = getQueryInfo("fromrules")
+	assert.True(t, ok)
+	assert.Equal(t, "3m", info.Schedule)
+	assert.True(t, isManaged("fromrules"))
+
+	//no rules file yet
+	e, dir2 := initRulesForTests(t, "")
+	defer os.RemoveAll(dir2)
+	assert.Nil(t, e.loadRules())
+	assert.Equal(t, 1, len(e.queries))
+}
+
+func Test_CheckRule(t *testing.T) {
+	_, dir := initRulesForTests(t, "")
+	defer os.RemoveAll(dir)
+
+	info, err := decodeRule([]byte(testRule))
+	assert.Nil(t, err)
+	a, errs := checkRule("errors", info)
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, "errors", a.name)
+	assert.Equal(t, 1, a.limit)
+
+	//json is yaml too
+	info, err = decodeRule([]byte(testRuleJSON))
+	assert.Nil(t, err)
+	assert.Equal(t, "5m", info.Schedule)
+	_, errs = checkRule("errors", info)
+	assert.Equal(t, 0, len(errs))
+
+	_, errs = checkRule("Errors", info)
+	assert.Equal(t, 1, len(errs))
+
+	//the digest isn't shared before the query is launched
+	g_digests.Lock()
+	nbDigests := len(g_digests.list)
+	g_digests.Unlock()
+	info, _ = decodeRule([]byte(testRule + "digest: 1h\nactions:\n  list: [email]\n  email:\n    to: [dev@example.com]\n"))
+	a, errs = checkRule("errors", info)
+	assert.Equal(t, 0, len(errs))
+	assert.NotNil(t, a.digest)
+	assert.False(t, a.checkOnly)
+	g_digests.Lock()
+	assert.Equal(t, nbDigests, len(g_digests.list))
+	g_digests.Unlock()
+	_, err = decodeRule([]byte(" "))
+	assert.NotNil(t, err)
+
+	//the errors of checkAndExit
+	info, _ = decodeRule([]byte(testRule + "actions:\n  list: [email]\n"))
+	_, errs = checkRule("errors", info)
+	assert.Equal(t, "No recipients defined for email action", errs[0].Error())
+	info, _ = decodeRule([]byte("schedule: pouet\ntimeout: 10s\npartial_results: maybe\nquery:\n  type: boolfilter\n"))
+	_, errs = checkRule("errors", info)
+	//no clauses, the schedule, no index, the partial_results
+	assert.Equal(t, 4, len(errs))
+}
+
+func Test_PutDeleteRule(t *testing.T) {
+	launched := make(chan string, 1)
+
+	setRuleLaunch(func(q queries.Query, name string, env *Env, control *queryControl) {
+		launched <- name
+		close(control.done)
+	})
+	defer setRuleLaunch(launchQuery)
+	e, dir := initRulesForTests(t, "")
+	defer os.RemoveAll(dir)
+	assert.Nil(t, e.loadRules())
+	stats.statsMap = make(map[string]queryStats)
+
+	info, _ := decodeRule([]byte(testRule))
+	a, _ := checkRule("errors", info)
+	assert.Nil(t, putRule("errors", info, a))
+	assert.Equal(t, "errors", <-launched)
+	assert.NotNil(t, getControl("errors"))
+	assert.True(t, isManaged("errors"))
+	_, ok := stats.statsMap["errors"]
+	assert.True(t, ok)
+
+	//a replaced query starts once the previous loop has ended
+	old := newQueryControl("errors", queryConfig{}, 0)
+	registerControl(old)
+	assert.Nil(t, putRule("errors", info, a))
+	assert.True(t, old.isStopped())
+	select {
+	case <-launched:
+		t.Error("started before the end of the previous loop")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(old.done)
+	assert.Equal(t, "errors", <-launched)
+	unregisterControl(old)
+
+	//the control of a query starting is known at once, the next PUT or DELETE
+	//stops it
+	setRuleLaunch(func(q queries.Query, name string, env *Env, control *queryControl) {
+		launched <- name
+	})
+	assert.Nil(t, putRule("errors", info, a))
+	first := getControl("errors")
+	assert.NotNil(t, first)
+	assert.Nil(t, first.getConfig())
+	assert.Equal(t, "errors", <-launched)
+	assert.Nil(t, putRule("errors", info, a))
+	assert.True(t, first.isStopped())
+	second := getControl("errors")
+	assert.False(t, second.isStopped())
+	close(first.done)
+	assert.Equal(t, "errors", <-launched)
+	close(second.done)
+
+	//saved in the rules file, and loaded at the next start
+	e, _ = initRulesForTests(t, "")
+	config.G_Config.Config.Rules_file = filepath.Join(dir, "rules.yml")
+	assert.Nil(t, e.loadRules())
+	saved, ok := getQueryInfo("errors")
+	assert.True(t, ok)
+	assert.Equal(t, "logs*", saved.Query.Index)
+	_, errs := checkRule("errors", &saved)
+	assert.Equal(t, 0, len(errs))
+
+	//the running query is stopped when deleted, and removed from its digest
+	control := newQueryControl("errors", queryConfig{}, 0)
+	registerControl(control)
+	d := newDigest(time.Hour, &saved)
+	d.addAlert("errors", 3)
+	d.addAlert("other", 5)
+	g_digests.Lock()
+	g_digests.list["test"] = d
+	g_digests.Unlock()
+	defer func() {
+		g_digests.Lock()
+		delete(g_digests.list, "test")
+		g_digests.Unlock()
+	}()
+	assert.Nil(t, deleteRule("errors"))
+	_, rows := d.getSummary()
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, "other", rows[0][0])
+	assert.True(t, control.isStopped())
+	assert.Nil(t, getControl("errors"))
+	assert.False(t, isManaged("errors"))
+	_, ok = getQueryInfo("errors")
+	assert.False(t, ok)
+	_, ok = stats.statsMap["errors"]
+	assert.False(t, ok)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "rules.yml"))
+	assert.Nil(t, err)
+	assert.Equal(t, "querylist: {}\n", string(content))
+}
@@ -3,15 +3,26 @@ package main
 import (
 	"errors"
 	"github.com/amundi/escheck/config"
+	"math/rand"
 	"time"
 )
 
+const (
+	DEFAULT_RETRY_BACKOFF    = 5 * time.Second
+	DEFAULT_SUSPEND_SCHEDULE = 1 * time.Hour
+)
+
 type scheduler struct {
 	isAlertOnlyOnce bool
 	isAlertEndMsg   bool
 	alertState      bool
 	alertSchedule   time.Duration
 	waitSchedule    time.Duration
+	//failing queries
+	maxRetries      int           //attempts before suspending the query, -1 for never
+	retryBackoff    time.Duration //wait after the first failure, doubled after each one
+	suspendSchedule time.Duration //schedule of a suspended query
+	control         *queryControl //wakes the query up before the end of a wait, if set
 }
 
 func (s *scheduler) initScheduler(info *config.Query) error {
@@ -41,5 +52,59 @@ func (s *scheduler) initSchedulerDefault() {
 }
 
 func (s *scheduler) wait() {
-	time.Sleep(s.waitSchedule)
+	s.sleep(s.waitSchedule)
+}
+
+func (s *scheduler) sleep(d time.Duration) {
+	if s.control != nil {
+		s.control.sleep(d)
+	} else {
+		time.Sleep(d)
+	}
+}
+
+// initRetries sets how a failing query is retried. maxRetries of the query
+// overrides the global one if not 0.
+func (s *scheduler) initRetries(maxRetries int, backoff string, suspend string) error {
+	var err error
+
+	s.maxRetries = maxRetries
+	s.retryBackoff = DEFAULT_RETRY_BACKOFF
+	s.suspendSchedule = DEFAULT_SUSPEND_SCHEDULE
+	if backoff != "" {
+		if s.retryBackoff, err = time.ParseDuration(backoff); err != nil || s.retryBackoff <= 0 {
+			s.retryBackoff = DEFAULT_RETRY_BACKOFF
+			return errors.New("invalid retry_backoff " + backoff + ", using the default one")
+		}
+	}
+	if suspend != "" {
+		if s.suspendSchedule, err = time.ParseDuration(suspend); err != nil || s.suspendSchedule <= 0 {
+			s.suspendSchedule = DEFAULT_SUSPEND_SCHEDULE
+			return errors.New("invalid suspend_schedule " + suspend + ", using the default one")
+		}
+	}
+	return nil
+}
+
+// getBackoff gives the time to wait after a number of failures in a row. It
+// doubles after each failure, without going over the schedule of the query, and
+// a random part is removed so that the failing queries don't all retry at the
+// same time.
+func (s *scheduler) getBackoff(failures int) time.Duration {
+	max := s.waitSchedule
+	ret := s.retryBackoff
+	for i := 1; i < failures && ret < max; i++ {
+		ret *= 2
+	}
+	if ret > max {
+		ret = max
+	}
+	if ret <= 1 {
+		return ret
+	}
+	return ret/2 + time.Duration(rand.Int63n(int64(ret/2)+1))
+}
+
+func (s *scheduler) waitSuspended() {
+	s.sleep(s.suspendSchedule)
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/amundi/escheck/eslog"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func Test_Scheduler(t *testing.T) {
@@ -66,4 +67,46 @@ func Test_Scheduler(t *testing.T) {
 	assert.Equal(t, "10m0s", sched.waitSchedule.String())
 	assert.Equal(t, "10m0s", sched.alertSchedule.String())
 	sched.initScheduler(info)
+
+	//the digest records the end of the alerts without end message
+	info = &config.Query{
+		Schedule:     "30m",
+		Alert_endmsg: false,
+		Digest:       "1h",
+	}
+	sched.initScheduler(info)
+	assert.Equal(t, false, sched.isAlertEndMsg)
+}
+
+func Test_InitRetries(t *testing.T) {
+	sched := new(scheduler)
+	assert.Nil(t, sched.initRetries(3, "", ""))
+	assert.Equal(t, 3, sched.maxRetries)
+	assert.Equal(t, DEFAULT_RETRY_BACKOFF, sched.retryBackoff)
+	assert.Equal(t, DEFAULT_SUSPEND_SCHEDULE, sched.suspendSchedule)
+
+	assert.Nil(t, sched.initRetries(-1, "1s", "30m"))
+	assert.Equal(t, -1, sched.maxRetries)
+	assert.Equal(t, "1s", sched.retryBackoff.String())
+	assert.Equal(t, "30m0s", sched.suspendSchedule.String())
+
+	assert.NotNil(t, sched.initRetries(3, "pouet", ""))
+	assert.Equal(t, DEFAULT_RETRY_BACKOFF, sched.retryBackoff)
+	assert.NotNil(t, sched.initRetries(3, "", "-1h"))
+	assert.Equal(t, DEFAULT_SUSPEND_SCHEDULE, sched.suspendSchedule)
+}
+
+func Test_Backoff(t *testing.T) {
+	sched := new(scheduler)
+	sched.initScheduler(&config.Query{Schedule: "1m"})
+	sched.initRetries(3, "5s", "")
+
+	//doubled after each failure, with jitter, never more than the schedule
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, max := range expected {
+		for j := 0; j < 20; j++ {
+			d := sched.getBackoff(i + 1)
+			assert.True(t, d >= max/2 && d <= max, "backoff %s after %d failures", d, i+1)
+		}
+	}
 }
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/amundi/escheck/config"
 	"gopkg.in/olivere/elastic.v2"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	FAIL = "Failed to initialize query information"
+	//scroll used to get more documents than nbdocs
+	SCROLL_KEEPALIVE = "1m"
+	SCROLL_PAGE_SIZE = 500
+	//time to get all the pages of a scroll
+	SCROLL_TIMEOUT       = 1 * time.Minute
+	CLEAR_SCROLL_TIMEOUT = 10 * time.Second
 )
 
 type sender struct {
@@ -18,6 +28,11 @@ type sender struct {
 	sortOrder bool
 	nbDocs    int
 	timeOut   time.Duration
+	fields    []string //fields of the _source to fetch, everything if empty
+	check     *checker //calls a cluster API instead of searching, if set
+	//only count the documents, without getting nor sorting them, when they
+	//are not displayed
+	countOnly bool
 }
 
 func (s *sender) initSender(info *config.Query) error {
@@ -26,7 +41,14 @@ func (s *sender) initSender(info *config.Query) error {
 	}
 
 	s.index = info.Query.Index
-	if s.index == "" {
+	s.check = nil
+	if isCheckType(info.Query.Type) {
+		check, err := newChecker(&info.Query)
+		if err != nil {
+			return err
+		}
+		s.check = check
+	} else if s.index == "" {
 		return errors.New("index cannot be empty")
 	}
 	s.sortBy = info.Query.SortBy
@@ -36,6 +58,7 @@ func (s *sender) initSender(info *config.Query) error {
 		s.sortOrder = false
 	}
 	s.nbDocs = info.Query.NbDocs
+	s.fields = getFetchedFields(info)
 	if info.TimeOut == "" {
 		s.timeOut = 30 * time.Second
 	} else {
@@ -49,36 +72,186 @@ func (s *sender) initSender(info *config.Query) error {
 	return nil
 }
 
-//the function sends the request in a goroutine, and sends back either the results,
-//either an error via their respective channels. In the meantive, the main goroutine
-//waits for the results, and leave if timeout is reached.
-func (s *sender) SendRequest(client *elastic.Client, query elastic.Query) (*elastic.SearchResult, error) {
-	resultsChan := make(chan *elastic.SearchResult, 1)
-	errChan := make(chan error, 1)
-
-	go func(client *elastic.Client, s *sender, query elastic.Query, resultsChan chan *elastic.SearchResult, errChan chan error) {
-		searchResults, err := client.Search().
-			Index(s.index).              // search in index
-			Query(query).                // specify the query
-			Sort(s.sortBy, s.sortOrder). // sort by "timestamp" DESC. The field must exist
-			From(0).Size(s.nbDocs).      // take documents 0-9
-			Pretty(false).               // pretty print request and response JSON
-			Do()
+// getFetchedFields gives the fields to fetch: the ones displayed, and the ones
+// attached to the mails. If no field is displayed, the whole documents are
+// fetched.
+func getFetchedFields(info *config.Query) []string {
+	if len(info.Query.Display_fields) == 0 {
+		return nil
+	}
+	ret := append([]string{}, info.Query.Display_fields...)
+	for _, field := range info.Actions.Email.Attach_fields {
+		if field != ID_COLUMN && !contains(ret, field) {
+			ret = append(ret, field)
+		}
+	}
+	return ret
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// SendRequest sends the request, and gives up when the timeout is reached. The
+// timeout is given to elasticsearch too, so that it stops searching.
+func (s *sender) SendRequest(c *cluster, query elastic.Query) (*elastic.SearchResult, error) {
+	var ret *elastic.SearchResult
+	var err error
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeOut)
+	defer cancel()
+	if s.check != nil {
+		ret, err = s.check.run(ctx, c)
+	} else if s.countOnly {
+		ret, err = count(ctx, c, s.index, query)
+	} else {
+		ret, err = search(ctx, c, s.index, nil, s.getSearchBody(query))
+	}
+	if err != nil && getErrorKind(err) == ERROR_TIMEOUT {
+		if s.check != nil {
+			return nil, newTimeoutError("%s check has timeout'ed", s.check.kind)
+		}
+		return nil, newTimeoutError("request in index %s has timeout'ed", s.index)
+	}
+	return ret, err
+}
+
+// sendTo sends the request in a slot of the cluster. The searches are grouped
+// with the other ones due at the same time, if the cluster allows it.
+func (s *sender) sendTo(c *cluster, query elastic.Query) (*elastic.SearchResult, error) {
+	if s.check == nil && c.isBatching() {
+		return c.search(s.index, s.getRequestBody(query), s.timeOut)
+	}
+	c.acquire()
+	defer c.release()
+	return s.SendRequest(c, query)
+}
+
+// getRequestBody gives the body of the search in a multi-search, where the
+// count API can't be used
+func (s *sender) getRequestBody(query elastic.Query) map[string]interface{} {
+	if s.countOnly {
+		return map[string]interface{}{"query": query.Source(), "size": 0, "timeout": getESTimeout(s.timeOut)}
+	}
+	return s.getSearchBody(query)
+}
+
+func (s *sender) getSearchBody(query elastic.Query) map[string]interface{} {
+	body := getSearchBody(query, s.sortBy, s.sortOrder, s.fields)
+	body["from"] = 0
+	body["size"] = s.nbDocs
+	body["timeout"] = getESTimeout(s.timeOut)
+	return body
+}
+
+// getSearchBody builds the body of a search. If fields are given, only them
+// are fetched in the _source of the documents.
+func getSearchBody(query elastic.Query, sortBy string, ascending bool, fields []string) map[string]interface{} {
+	body := map[string]interface{}{"query": query.Source()}
+	if sortBy != "" {
+		order := "desc"
+		if ascending {
+			order = "asc"
+		}
+		body["sort"] = []interface{}{map[string]interface{}{sortBy: map[string]string{"order": order}}}
+	}
+	if len(fields) > 0 {
+		body["_source"] = fields
+	}
+	return body
+}
+
+func search(ctx context.Context, c *cluster, index string, params url.Values, body interface{}) (*elastic.SearchResult, error) {
+	res, err := c.performRequest(ctx, "POST", "/"+index+"/_search", params, body)
+	if err != nil {
+		return nil, err
+	}
+	ret := new(elastic.SearchResult)
+	if err = json.Unmarshal(res, ret); err != nil {
+		return nil, &requestError{ERROR_TRANSPORT, err}
+	}
+	return ret, nil
+}
+
+// count uses the count API, cheaper than a search, and gives the number of
+// documents as the total hits of a search result
+func count(ctx context.Context, c *cluster, index string, query elastic.Query) (*elastic.SearchResult, error) {
+	var count struct {
+		Count int64 `json:"count"`
+	}
+
+	res, err := c.performRequest(ctx, "POST", "/"+index+"/_count", nil, map[string]interface{}{"query": query.Source()})
+	if err != nil {
+		return nil, err
+	}
+	//the result keeps the _shards of the count, to see the failed ones
+	ret := new(elastic.SearchResult)
+	if err = json.Unmarshal(res, ret); err != nil {
+		return nil, &requestError{ERROR_TRANSPORT, err}
+	}
+	if err = json.Unmarshal(res, &count); err != nil {
+		return nil, &requestError{ERROR_TRANSPORT, err}
+	}
+	ret.Hits = &elastic.SearchHits{TotalHits: count.Count}
+	return ret, nil
+}
+
+// scrollDocuments gets up to max documents of a search, page by page, when the
+// nbdocs of a search are not enough
+func scrollDocuments(c *cluster, index string, body map[string]interface{}, max int) ([]*elastic.SearchHit, error) {
+	var ret []*elastic.SearchHit
 
+	if c == nil || body == nil {
+		return nil, errors.New("nothing to scroll")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SCROLL_TIMEOUT)
+	defer cancel()
+	size := SCROLL_PAGE_SIZE
+	if max < size {
+		size = max
+	}
+	params := url.Values{"scroll": {SCROLL_KEEPALIVE}, "size": {strconv.Itoa(size)}}
+	page, err := search(ctx, c, index, params, body)
+	for {
 		if err != nil {
-			errChan <- err
-		} else {
-			resultsChan <- searchResults
+			return ret, err
+		}
+		if page.Hits == nil || len(page.Hits.Hits) == 0 {
+			clearScroll(c, page.ScrollId)
+			return ret, nil
 		}
-	}(client, s, query, resultsChan, errChan)
+		ret = append(ret, page.Hits.Hits...)
+		if len(ret) >= max {
+			clearScroll(c, page.ScrollId)
+			return ret[:max], nil
+		}
+		page, err = scroll(ctx, c, page.ScrollId)
+	}
+}
 
-	//wait for result, or leave because timeout
-	select {
-	case ret := <-resultsChan:
-		return ret, nil
-	case err := <-errChan:
+func scroll(ctx context.Context, c *cluster, scrollId string) (*elastic.SearchResult, error) {
+	params := url.Values{"scroll": {SCROLL_KEEPALIVE}, "scroll_id": {scrollId}}
+	res, err := c.performRequest(ctx, "GET", "/_search/scroll", params, nil)
+	if err != nil {
 		return nil, err
-	case <-time.After(s.timeOut):
-		return nil, fmt.Errorf("request in index %s has timeout'ed", s.index)
+	}
+	ret := new(elastic.SearchResult)
+	if err = json.Unmarshal(res, ret); err != nil {
+		return nil, &requestError{ERROR_TRANSPORT, err}
+	}
+	return ret, nil
+}
+
+// free the scroll in the cluster without waiting for the keepalive
+func clearScroll(c *cluster, scrollId string) {
+	if strings.TrimSpace(scrollId) != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), CLEAR_SCROLL_TIMEOUT)
+		defer cancel()
+		c.performRequest(ctx, "DELETE", "/_search/scroll/"+url.QueryEscape(scrollId), nil, nil)
 	}
 }
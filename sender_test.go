@@ -4,6 +4,7 @@ import (
 	"github.com/amundi/escheck/config"
 	"github.com/amundi/escheck/eslog"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
 	"testing"
 	"time"
 )
@@ -90,4 +91,51 @@ func Test_SenderInit(t *testing.T) {
 	}
 	err = s.initSender(info)
 	assert.NotNil(t, err)
+
+	//checks don't need an index
+	info = &config.Query{
+		Query: config.QueryInfo{Type: CHECK_CLUSTER_HEALTH},
+	}
+	err = s.initSender(info)
+	assert.Nil(t, err)
+	assert.NotNil(t, s.check)
+	info.Query.Type = CHECK_INDEX_STATS
+	err = s.initSender(info)
+	assert.NotNil(t, err)
+}
+
+func Test_GetSearchBody(t *testing.T) {
+	s := new(sender)
+	info := &config.Query{
+		Query: config.QueryInfo{
+			Index:          "testindex*",
+			SortBy:         "Timestamp",
+			SortOrder:      "ASC",
+			NbDocs:         10,
+			Display_fields: []string{"status", "host.name"},
+		},
+		Actions: config.Actions{
+			Email: config.Email{Attach_fields: []string{"_id", "status", "message"}},
+		},
+	}
+	err := s.initSender(info)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"status", "host.name", "message"}, s.fields)
+
+	query := elastic.NewQueryStringQuery("status:500")
+	body := s.getSearchBody(query)
+	assert.Equal(t, query.Source(), body["query"])
+	assert.Equal(t, 0, body["from"])
+	assert.Equal(t, 10, body["size"])
+	assert.Equal(t, []string{"status", "host.name", "message"}, body["_source"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"Timestamp": map[string]string{"order": "asc"}}}, body["sort"])
+
+	//everything is fetched without display fields, no sort without sortby
+	info.Query.Display_fields = nil
+	info.Query.SortBy = ""
+	err = s.initSender(info)
+	assert.Nil(t, err)
+	body = s.getSearchBody(query)
+	assert.Nil(t, body["_source"])
+	assert.Nil(t, body["sort"])
 }
@@ -4,8 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/amundi/escheck/worker"
+	"gopkg.in/olivere/elastic.v2"
 	"net/http"
 	"sync"
+	"time"
+)
+
+const (
+	//number of runs kept to show the trend of the hits
+	HITS_TREND_SIZE = 20
 )
 
 type queryStats struct {
@@ -14,6 +21,31 @@ type queryStats struct {
 	Tries       int
 	NbAlerts    int
 	LastAlert   string
+	//notifications of the query that failed to be delivered, and the ones
+	//given up after retrying them
+	DeliveryFailures int
+	DroppedNotifs    int
+	//the query failed too many times, and is only tried at a slow interval
+	Suspended bool
+	//failures of the requests, by kind, and the last one
+	Timeouts        int
+	TransportErrors int
+	QueryErrors     int
+	LastError       string
+	//some shards failed in the last results, and the number of such results
+	Degraded       bool
+	PartialResults int
+	//when the query was sent for the last time, and will be sent again
+	LastRun string
+	NextRun string
+	//number of hits of the last runs, the oldest first
+	Hits []int64
+	//the current alert, and who acknowledged it
+	AlertId string
+	AckBy   string
+	AckAt   string
+	//info, warning or critical
+	Severity string
 }
 
 //request to update the globalstats struct
@@ -22,6 +54,12 @@ type queryStatsRequest struct {
 	stats     queryStats
 }
 
+//request to count a failed notification
+type deliveryFailureRequest struct {
+	queryName string
+	dropped   bool
+}
+
 //request do create the stats page and display it
 type displayStatsRequest struct {
 	w http.ResponseWriter
@@ -39,8 +77,74 @@ var stats globalStats
 func initStats() {
 	stats.statsMap = make(map[string]queryStats)
 	for k, _ := range g_queryList {
-		stats.statsMap[k] = queryStats{true, false, 0, 0, "None"}
+		stats.statsMap[k] = newQueryStats()
+	}
+}
+
+func newQueryStats() queryStats {
+	return queryStats{
+		IsUp:      true,
+		LastAlert: "None",
+		LastError: "None",
+		LastRun:   "None",
+		NextRun:   "None",
+		AlertId:   "None",
+		AckBy:     "None",
+		AckAt:     "None",
+		Severity:  "None",
+	}
+}
+
+// resetStats starts the stats of a query created by the API
+func resetStats(name string) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.statsMap[name] = newQueryStats()
+}
+
+func deleteStats(name string) {
+	stats.Lock()
+	defer stats.Unlock()
+	delete(stats.statsMap, name)
+}
+
+// countError counts a failed request of launchQuery by its kind
+func countError(s *queryStats, err error) {
+	switch getErrorKind(err) {
+	case ERROR_TIMEOUT:
+		s.Timeouts++
+	case ERROR_QUERY:
+		s.QueryErrors++
+	case ERROR_PARTIAL:
+		s.PartialResults++
+	default:
+		s.TransportErrors++
 	}
+	s.LastError = err.Error()
+}
+
+// setRun tells that the query has just run, and runs again after next
+func (s *queryStats) setRun(next time.Duration) {
+	now := time.Now()
+	s.LastRun = now.Format(TIMELAYOUT)
+	s.NextRun = now.Add(next).Format(TIMELAYOUT)
+}
+
+// addHits gives the hits of the last runs with the ones of results. A new
+// slice is made, as the stats are shared with the workers.
+func addHits(hits []int64, results *elastic.SearchResult) []int64 {
+	var total int64
+
+	if results != nil && results.Hits != nil {
+		total = results.Hits.TotalHits
+	}
+	start := 0
+	if len(hits) >= HITS_TREND_SIZE {
+		start = len(hits) - HITS_TREND_SIZE + 1
+	}
+	ret := make([]int64, 0, HITS_TREND_SIZE)
+	ret = append(ret, hits[start:]...)
+	return append(ret, total)
 }
 
 // collector for stats update in launchQuery
@@ -48,6 +152,13 @@ func collectorUpdate(r queryStats, name string) {
 	worker.G_WorkQueue <- queryStatsRequest{name, r}
 }
 
+// collector for the notifications that failed, called by the outbox
+func collectorDeliveryFailure(origin string, dropped bool, err error) {
+	if origin != "" {
+		worker.G_WorkQueue <- deliveryFailureRequest{origin, dropped}
+	}
+}
+
 // collector for updating page in server
 // chan is used to wait and be sure that something is written in responsewriter
 func collectorDisplay(w http.ResponseWriter, r *http.Request) {
@@ -59,11 +170,32 @@ func collectorDisplay(w http.ResponseWriter, r *http.Request) {
 func (q queryStatsRequest) DoRequest() {
 	stats.Lock()
 	defer stats.Unlock()
-	if _, exists := stats.statsMap[q.queryName]; exists {
+	if old, exists := stats.statsMap[q.queryName]; exists {
+		//the delivery counters are updated by the outbox, not by launchQuery
+		q.stats.DeliveryFailures = old.DeliveryFailures
+		q.stats.DroppedNotifs = old.DroppedNotifs
 		stats.statsMap[q.queryName] = q.stats
 	}
 }
 
+func (d deliveryFailureRequest) DoRequest() {
+	if d.dropped {
+		historyDelivery(d.queryName, DELIVERY_DROPPED)
+	} else {
+		historyDelivery(d.queryName, DELIVERY_RETRYING)
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	if s, exists := stats.statsMap[d.queryName]; exists {
+		if d.dropped {
+			s.DroppedNotifs++
+		} else {
+			s.DeliveryFailures++
+		}
+		stats.statsMap[d.queryName] = s
+	}
+}
+
 func (q displayStatsRequest) DoRequest() {
 	fmt.Fprintf(q.w, formatQueriesForLayout())
 	q.c <- struct{}{}
@@ -4,6 +4,7 @@ import (
 	"github.com/amundi/escheck/eslog"
 	"github.com/amundi/escheck/worker"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v2"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -12,13 +13,13 @@ import (
 
 func initStatsForTests1() {
 	stats.statsMap = make(map[string]queryStats)
-	stats.statsMap["Test"] = queryStats{true, false, 3, 0, "Yesterday"}
-	stats.statsMap["Test"] = queryStats{true, false, 3, 0, "Yesterday"}
+	stats.statsMap["Test"] = queryStats{IsUp: true, AlertStatus: false, Tries: 3, NbAlerts: 0, LastAlert: "Yesterday"}
+	stats.statsMap["Test"] = queryStats{IsUp: true, AlertStatus: false, Tries: 3, NbAlerts: 0, LastAlert: "Yesterday"}
 }
 
 func initStatsForTests2() {
 	stats.statsMap = make(map[string]queryStats)
-	stats.statsMap["Test"] = queryStats{true, true, 3, 0, "Now"}
+	stats.statsMap["Test"] = queryStats{IsUp: true, AlertStatus: true, Tries: 3, NbAlerts: 0, LastAlert: "Now"}
 }
 
 func Test_DisplayPage(t *testing.T) {
@@ -37,3 +38,34 @@ func Test_DisplayPage(t *testing.T) {
 	assert.Equal(t, expected, string(page))
 	worker.StopAllWorkers(32)
 }
+
+func Test_DeliveryFailures(t *testing.T) {
+	initStatsForTests2()
+	deliveryFailureRequest{"Test", false}.DoRequest()
+	deliveryFailureRequest{"Test", false}.DoRequest()
+	deliveryFailureRequest{"Test", true}.DoRequest()
+	deliveryFailureRequest{"Unknown", true}.DoRequest()
+	assert.Equal(t, 2, stats.statsMap["Test"].DeliveryFailures)
+	assert.Equal(t, 1, stats.statsMap["Test"].DroppedNotifs)
+
+	//launchQuery doesn't reset the counters
+	queryStatsRequest{"Test", queryStats{IsUp: true, AlertStatus: false, Tries: 3, NbAlerts: 1, LastAlert: "Now"}}.DoRequest()
+	assert.Equal(t, 2, stats.statsMap["Test"].DeliveryFailures)
+	assert.Equal(t, 1, stats.statsMap["Test"].DroppedNotifs)
+	assert.Equal(t, 1, stats.statsMap["Test"].NbAlerts)
+}
+
+func Test_AddHits(t *testing.T) {
+	hits := addHits(nil, nil)
+	assert.Equal(t, []int64{0}, hits)
+	hits = addHits(hits, &elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: 12}})
+	assert.Equal(t, []int64{0, 12}, hits)
+
+	//only the last runs are kept
+	for i := 0; i < HITS_TREND_SIZE; i++ {
+		hits = addHits(hits, &elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: int64(i)}})
+	}
+	assert.Equal(t, HITS_TREND_SIZE, len(hits))
+	assert.Equal(t, int64(0), hits[0])
+	assert.Equal(t, int64(HITS_TREND_SIZE-1), hits[HITS_TREND_SIZE-1])
+}